@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/netip"
+	"os"
+	"os/signal"
+	"sort"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// aclRule is a compiled ACLConfiguration: CIDRs are parsed into netip.Prefix
+// once at compile time instead of on every packet, and the fields that only
+// matter once a rule has already been picked as the winner (ExternalPorts,
+// MaxLeasesPerClient, LeaseTTL) ride along without going back to the raw
+// config. aclCheckerFor applies MaxLeasesPerClient and LeaseTTL;
+// externalPorts is kept here but is not applied to port allocation.
+type aclRule struct {
+	order              int
+	cidr               netip.Prefix
+	cidrv6             netip.Prefix
+	internalPorts      string
+	externalPorts      string
+	protocol           PROTOCOL
+	anyProtocol        bool
+	maxLeasesPerClient uint32
+	leaseTTL           time.Duration
+	deny               bool
+}
+
+func (r *aclRule) matches(protocol PROTOCOL, port uint16) bool {
+	if !r.anyProtocol && r.protocol != protocol {
+		return false
+	}
+	return isPortInRange(port, r.internalPorts)
+}
+
+// aclTrieNode is one level of a binary trie over address bits, one node per
+// bit. rules is only non-empty at the node where some rule's CIDR prefix
+// ends, so walking an address bit by bit from the root and collecting rules
+// at every node visited yields exactly the rules whose CIDR contains that
+// address - an O(address length) candidate lookup instead of the O(len(acl))
+// linear scan over every rule the old per-request ACL loop did.
+type aclTrieNode struct {
+	children [2]*aclTrieNode
+	rules    []int
+}
+
+func (n *aclTrieNode) insert(prefix netip.Prefix, ruleIdx int) {
+	node := n
+	addr := prefix.Addr()
+	for i := 0; i < prefix.Bits(); i++ {
+		bit := addrBit(addr, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &aclTrieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.rules = append(node.rules, ruleIdx)
+}
+
+func (n *aclTrieNode) collect(addr netip.Addr, bits int) []int {
+	node := n
+	candidates := append([]int(nil), node.rules...)
+	for i := 0; i < bits; i++ {
+		node = node.children[addrBit(addr, i)]
+		if node == nil {
+			break
+		}
+		candidates = append(candidates, node.rules...)
+	}
+	return candidates
+}
+
+// addrBit returns the i-th most-significant bit of addr (0 = MSB of the
+// first byte), the order netip.Prefix.Bits() counts a prefix length in.
+func addrBit(addr netip.Addr, i int) int {
+	b := addr.AsSlice()
+	return int((b[i/8] >> (7 - uint(i%8))) & 1)
+}
+
+// ACLPolicy is the compiled form of a []ACLConfiguration, indexed into a
+// v4 and a v6 prefix trie so pcpserver.Server's per-request Evaluate call
+// stays cheap regardless of how large the ACL grows.
+type ACLPolicy struct {
+	rules        []aclRule
+	v4           *aclTrieNode
+	v6           *aclTrieNode
+	allowDefault bool
+}
+
+// compileACLPolicy parses every rule's CIDRs and inserts them into the v4/v6
+// tries, logging and skipping anything that fails to parse rather than
+// failing the whole policy - the same "warn and keep going" behaviour the
+// old per-request ACL loop had for a bad CIDR.
+func compileACLPolicy(l *zap.SugaredLogger, acl []ACLConfiguration, allowDefault bool) *ACLPolicy {
+	p := &ACLPolicy{v4: &aclTrieNode{}, v6: &aclTrieNode{}, allowDefault: allowDefault}
+	p.rules = make([]aclRule, len(acl))
+	for i, a := range acl {
+		rule := &p.rules[i]
+		rule.order = i
+		rule.internalPorts = a.InternalPorts
+		rule.externalPorts = a.ExternalPorts
+		rule.maxLeasesPerClient = a.MaxLeasesPerClient
+		rule.deny = a.Deny
+
+		switch a.Protocol {
+		case "tcp":
+			rule.protocol = TCP
+		case "udp":
+			rule.protocol = UDP
+		default:
+			rule.anyProtocol = true
+		}
+
+		if a.LeaseTTL != "" {
+			ttl, err := time.ParseDuration(a.LeaseTTL)
+			if err != nil {
+				l.With(zap.Error(err)).Warnf("failed to parse lease_ttl %s", a.LeaseTTL)
+			} else {
+				rule.leaseTTL = ttl
+			}
+		}
+
+		if a.CIDR != "" {
+			prefix, err := netip.ParsePrefix(a.CIDR)
+			if err != nil {
+				l.With(zap.Error(err)).Warnf("failed to parse cidr %s", a.CIDR)
+			} else {
+				rule.cidr = prefix
+				p.v4.insert(prefix, i)
+			}
+		}
+		if a.CIDRv6 != "" {
+			prefix, err := netip.ParsePrefix(a.CIDRv6)
+			if err != nil {
+				l.With(zap.Error(err)).Warnf("failed to parse cidr %s", a.CIDRv6)
+			} else {
+				rule.cidrv6 = prefix
+				p.v6.insert(prefix, i)
+			}
+		}
+	}
+	return p
+}
+
+// Evaluate decides whether clientIP may map port over protocol, and returns
+// the rule that decided it (nil if no rule matched). It replays the
+// trie-selected candidates in their original config order, keeping the
+// semantics the old per-request ACL loop had: the first candidate that
+// matches protocol+port and allows ends the scan, while a matching deny
+// sets the verdict but doesn't stop the scan - any later matching allow
+// rule, in config order, still overrides it.
+func (p *ACLPolicy) Evaluate(clientIP netip.Addr, protocol PROTOCOL, port uint16) (bool, *aclRule) {
+	allowed := p.allowDefault
+	if p == nil {
+		return allowed, nil
+	}
+
+	trie, bits := p.v4, 32
+	if clientIP.Is6() && !clientIP.Is4In6() {
+		trie, bits = p.v6, 128
+	}
+	candidates := trie.collect(clientIP, bits)
+	sort.Ints(candidates)
+
+	var winner *aclRule
+	for _, idx := range candidates {
+		rule := &p.rules[idx]
+		if !rule.matches(protocol, port) {
+			continue
+		}
+		allowed = !rule.deny
+		winner = rule
+		if allowed {
+			break
+		}
+	}
+	return allowed, winner
+}
+
+// aclPolicyHolder gives pcpserver.Server's ACL checker the same atomic-swap
+// compile-once-reload-anytime behaviour: Evaluate always reads a
+// fully-formed *ACLPolicy, and set/WatchSIGHUP only ever publish a new one,
+// so concurrent requests never observe a partially rebuilt policy.
+type aclPolicyHolder struct {
+	policy atomic.Pointer[ACLPolicy]
+}
+
+func (h *aclPolicyHolder) set(l *zap.SugaredLogger, acl []ACLConfiguration, allowDefault bool) {
+	h.policy.Store(compileACLPolicy(l, acl, allowDefault))
+}
+
+func (h *aclPolicyHolder) get() *ACLPolicy {
+	return h.policy.Load()
+}
+
+// WatchSIGHUP calls reload every time the process receives SIGHUP, without
+// restarting listeners. The reload start() passes recompiles config.ACL as
+// it was loaded at startup and swaps aclPolicyHolder.policy atomically; the
+// config file is not read again, so edits to it are not picked up.
+func WatchSIGHUP(l *zap.SugaredLogger, reload func()) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			l.Info("received SIGHUP, reloading ACL")
+			reload()
+		}
+	}()
+}
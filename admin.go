@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/netip"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// AdminServer exposes a small non-NAT-PMP HTTP API used by the dynport-cni
+// plugin (and other out-of-band integrations) to look up and reap the
+// mappings it created for a given container, without having to speak
+// NAT-PMP/PCP itself for CHECK/GC.
+type AdminServer struct {
+	l          *zap.Logger
+	g          *gin.Engine
+	store      *DataStore
+	listenAddr string
+	listeners  []func()
+}
+
+func NewAdminServer(l *zap.Logger, store *DataStore, listenAddr string) *AdminServer {
+	gin.SetMode("release")
+	g := gin.New()
+	g.Use(ginzapWithRecovery(l, zapcore.DebugLevel))
+
+	a := &AdminServer{l: l, g: g, store: store, listenAddr: listenAddr}
+	a.setupHandlers()
+	return a
+}
+
+func (a *AdminServer) RegisterUpdateListener(fn func()) {
+	a.listeners = append(a.listeners, fn)
+}
+
+func (a *AdminServer) sendUpdate() {
+	for _, fn := range a.listeners {
+		go fn()
+	}
+}
+
+func (a *AdminServer) Start() {
+	if a.listenAddr == "" {
+		a.l.Sugar().Info("admin api is not enabled")
+		return
+	}
+	go func() {
+		if err := a.g.Run(a.listenAddr); err != nil {
+			a.l.With(zap.Error(err)).Error("failed to start admin api")
+		}
+	}()
+}
+
+func (a *AdminServer) setupHandlers() {
+	g := a.g
+	g.GET("/containers/:id/mappings", func(c *gin.Context) {
+		leases, err := a.store.GetLeasesByContainerID(c.Param("id"))
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		c.JSON(200, leases)
+	})
+	// Tags a lease the plugin just created over NAT-PMP/PCP with the
+	// container it belongs to, since neither protocol carries that field.
+	// Looked up the same way dynport-server itself finds a lease: by
+	// client IP, internal port and protocol, all of which the CNI plugin
+	// already knows from prevResult/runtimeConfig.
+	g.PUT("/containers/:id/mappings", func(c *gin.Context) {
+		clientIP, ipErr := netip.ParseAddr(c.Query("clientIP"))
+		internalPort, err := strconv.ParseUint(c.Query("internalPort"), 10, 16)
+		if ipErr != nil || err != nil {
+			c.AbortWithStatus(400)
+			return
+		}
+		var protocol PROTOCOL
+		if c.Query("protocol") == "tcp" {
+			protocol = TCP
+		} else {
+			protocol = UDP
+		}
+
+		lease, err := a.store.GetLeaseByIpAndPort(clientIP, uint16(internalPort), protocol)
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		if lease == nil {
+			c.AbortWithStatus(404)
+			return
+		}
+		lease.ContainerID = c.Param("id")
+		if err := a.store.UpsertLease(lease); err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		c.Status(204)
+	})
+	// GC reaps every mapping the plugin created for a container, called on
+	// pod teardown (CNI DEL) or periodic garbage collection (CNI GC).
+	g.DELETE("/containers/:id/mappings", func(c *gin.Context) {
+		leases, err := a.store.GetLeasesByContainerID(c.Param("id"))
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		for _, lease := range leases {
+			if err := a.store.DeleteLease(lease.Id); err != nil {
+				a.l.Sugar().With(zap.Error(err)).Warnf("failed to delete lease %s during gc", lease.Id)
+			}
+		}
+		a.sendUpdate()
+		c.Status(204)
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TestAdminServer_TagAndListContainerMappings is a regression test for the
+// dynport-cni CHECK/GC path: PUT /containers/:id/mappings tags an existing
+// lease with a ContainerID, and GET (used by CHECK) plus DELETE (used by GC)
+// both rely on that tag having actually persisted through UpsertLease.
+func TestAdminServer_TagAndListContainerMappings(t *testing.T) {
+	store, err := NewDataStore(zap.NewNop(), t.TempDir(), 10000, 19999, "test-node")
+	if err != nil {
+		t.Fatalf("failed to open datastore: %v", err)
+	}
+	defer store.Close()
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	lease := &PortMappingLease{
+		Id:         leaseHash(TCP, ip, 80),
+		ClientIP:   ip,
+		ClientPort: 80,
+		Protocol:   TCP,
+		LastSeen:   time.Now(),
+	}
+	if err := store.UpsertLease(lease); err != nil {
+		t.Fatalf("failed to seed lease: %v", err)
+	}
+
+	admin := NewAdminServer(zap.NewNop(), store, "")
+	srv := httptest.NewServer(admin.g)
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodPut, srv.URL+"/containers/container-123/mappings?clientIP=192.0.2.1&internalPort=80&protocol=tcp", nil)
+	if err != nil {
+		t.Fatalf("failed to build PUT request: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("PUT /containers/.../mappings: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT /containers/.../mappings: got status %d, want %d", resp.StatusCode, http.StatusNoContent)
+	}
+
+	tagged, err := store.GetLeasesByContainerID("container-123")
+	if err != nil {
+		t.Fatalf("GetLeasesByContainerID: %v", err)
+	}
+	if len(tagged) != 1 || tagged[0].Id != lease.Id {
+		t.Fatalf("expected tagged lease %s to be found by container id, got %v", lease.Id, tagged)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/ec2/imds"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
+	"go.uber.org/zap"
+)
+
+// sgRuleDescriptionPrefix namespaces every ingress rule this backend owns,
+// the same role chain_port_mapping plays for IPTablesManager: rules tagged
+// with it are ours to delete once they're no longer in the desired set,
+// anything else in the security group is left alone.
+const sgRuleDescriptionPrefix = "dynport:"
+
+// AWSBackend is a PortPublisher that publishes ports by opening security
+// group ingress for each external port instead of programming local
+// iptables NAT, for instances behind an AWS VPC where the instance's own
+// netfilter rules never see traffic a security group already dropped.
+// Patterned after flannel's AwsVpcBackend: detect the instance and its VPC
+// from the IMDS metadata service, resolve the instance's route table and
+// elastic IP once at startup, then reconcile desired vs. actual ingress
+// rules via list+diff the same way IPTablesManager reconciles chains.
+type AWSBackend struct {
+	l          *zap.SugaredLogger
+	ec2        *ec2.Client
+	instanceID string
+	vpcID      string
+	sgID       string
+	externalIP net.IP
+
+	reconcileCh      chan interface{}
+	reconcileCloseCh chan interface{}
+}
+
+// NewAWSBackend detects the instance, VPC and primary security group via
+// IMDSv2, resolves the route table for the instance's subnet and takes the
+// instance's public IP as its external address (the private IP when it has
+// none), then returns a backend ready to reconcile security-group ingress
+// against the lease table.
+func NewAWSBackend(l *zap.Logger) (*AWSBackend, error) {
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load aws config: %v", err)
+	}
+
+	imdsClient := imds.NewFromConfig(cfg)
+	idDoc, err := imdsClient.GetInstanceIdentityDocument(ctx, &imds.GetInstanceIdentityDocumentInput{})
+	if err != nil {
+		return nil, fmt.Errorf("aws backend selected but IMDS is unreachable: %v", err)
+	}
+
+	cfg.Region = idDoc.Region
+	ec2Client := ec2.NewFromConfig(cfg)
+
+	instances, err := ec2Client.DescribeInstances(ctx, &ec2.DescribeInstancesInput{
+		InstanceIds: []string{idDoc.InstanceID},
+	})
+	if err != nil || len(instances.Reservations) == 0 || len(instances.Reservations[0].Instances) == 0 {
+		return nil, fmt.Errorf("failed to describe instance %s: %v", idDoc.InstanceID, err)
+	}
+	instance := instances.Reservations[0].Instances[0]
+	if len(instance.SecurityGroups) == 0 {
+		return nil, fmt.Errorf("instance %s has no security group to manage ingress on", idDoc.InstanceID)
+	}
+
+	externalIP := idDoc.PrivateIP
+	if instance.PublicIpAddress != nil {
+		externalIP = *instance.PublicIpAddress
+	}
+
+	b := &AWSBackend{
+		l:                l.Sugar(),
+		ec2:              ec2Client,
+		instanceID:       idDoc.InstanceID,
+		vpcID:            idDoc.VpcID,
+		sgID:             *instance.SecurityGroups[0].GroupId,
+		externalIP:       net.ParseIP(externalIP),
+		reconcileCh:      make(chan interface{}),
+		reconcileCloseCh: make(chan interface{}),
+	}
+	if err := b.ensureRouteTable(ctx, instance); err != nil {
+		return nil, fmt.Errorf("failed to ensure route table for %s: %v", idDoc.InstanceID, err)
+	}
+	return b, nil
+}
+
+// ExternalIP reports the instance's elastic/public IP as discovered from
+// IMDS, falling back to the private IP when no elastic IP is associated.
+func (a *AWSBackend) ExternalIP() net.IP {
+	return a.externalIP
+}
+
+// ensureRouteTable confirms a route table is explicitly associated with the
+// instance's subnet, the one-time, instance-level check equivalent to
+// IPTablesManager.CheckPrerequisite. It does not inspect or change the
+// routes in that table.
+func (a *AWSBackend) ensureRouteTable(ctx context.Context, instance types.Instance) error {
+	if instance.SubnetId == nil {
+		return fmt.Errorf("instance has no subnet, can't resolve its route table")
+	}
+	tables, err := a.ec2.DescribeRouteTables(ctx, &ec2.DescribeRouteTablesInput{
+		Filters: []types.Filter{
+			{Name: aws.String("association.subnet-id"), Values: []string{*instance.SubnetId}},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if len(tables.RouteTables) == 0 {
+		return fmt.Errorf("no route table associated with subnet %s", *instance.SubnetId)
+	}
+	a.l.Debugf("using route table %s for subnet %s", *tables.RouteTables[0].RouteTableId, *instance.SubnetId)
+	return nil
+}
+
+func (a *AWSBackend) StartReconcile(leasesFn func() ([]*PortMappingLease, error)) {
+	timer := time.NewTicker(2 * time.Minute)
+	reconcileFn := func() {
+		a.l.Debug("reconcile aws security group ingress")
+		leases, err := leasesFn()
+		if err != nil {
+			return
+		}
+		a.EnsureMappings(leases)
+	}
+	for {
+		select {
+		case <-timer.C:
+			reconcileFn()
+		case <-a.reconcileCh:
+			reconcileFn()
+		case <-a.reconcileCloseCh:
+			return
+		}
+	}
+}
+
+func (a *AWSBackend) Close() {
+	a.reconcileCloseCh <- true
+}
+
+func (a *AWSBackend) Reconcile() {
+	a.reconcileCh <- true
+}
+
+func (a *AWSBackend) ruleDescription(lease *PortMappingLease) string {
+	return fmt.Sprintf("%s%s", sgRuleDescriptionPrefix, lease.Id)
+}
+
+// EnsureMappings lists every ingress rule this backend owns (tagged via its
+// description) and diffs it against the desired set from leases, revoking
+// what's stale and authorizing what's missing.
+func (a *AWSBackend) EnsureMappings(leases []*PortMappingLease) {
+	ctx := context.Background()
+	sg, err := a.ec2.DescribeSecurityGroups(ctx, &ec2.DescribeSecurityGroupsInput{GroupIds: []string{a.sgID}})
+	if err != nil || len(sg.SecurityGroups) == 0 {
+		a.l.With(zap.Error(err)).Error("failed to describe security group")
+		return
+	}
+
+	existing := make(map[string]bool)
+	for _, perm := range sg.SecurityGroups[0].IpPermissions {
+		for _, ipRange := range perm.IpRanges {
+			if ipRange.Description != nil {
+				existing[*ipRange.Description] = true
+			}
+		}
+	}
+
+	desired := make(map[string]*PortMappingLease, len(leases))
+	for _, lease := range leases {
+		desired[a.ruleDescription(lease)] = lease
+	}
+
+	for desc := range existing {
+		if !strings.HasPrefix(desc, sgRuleDescriptionPrefix) {
+			continue
+		}
+		if _, ok := desired[desc]; !ok {
+			a.revokeIngress(ctx, desc)
+		}
+	}
+	for desc, lease := range desired {
+		if existing[desc] {
+			continue
+		}
+		a.authorizeIngress(ctx, desc, lease)
+	}
+}
+
+func (a *AWSBackend) authorizeIngress(ctx context.Context, description string, lease *PortMappingLease) {
+	protocol := "udp"
+	if lease.Protocol == TCP {
+		protocol = "tcp"
+	}
+	port := int32(lease.ExternalPort)
+	_, err := a.ec2.AuthorizeSecurityGroupIngress(ctx, &ec2.AuthorizeSecurityGroupIngressInput{
+		GroupId: aws.String(a.sgID),
+		IpPermissions: []types.IpPermission{
+			{
+				IpProtocol: aws.String(protocol),
+				FromPort:   aws.Int32(port),
+				ToPort:     aws.Int32(port),
+				IpRanges:   []types.IpRange{{CidrIp: aws.String("0.0.0.0/0"), Description: aws.String(description)}},
+			},
+		},
+	})
+	if err != nil {
+		a.l.With(zap.Error(err)).Warnf("failed to authorize ingress for %s", description)
+	}
+}
+
+func (a *AWSBackend) revokeIngress(ctx context.Context, description string) {
+	_, err := a.ec2.RevokeSecurityGroupIngress(ctx, &ec2.RevokeSecurityGroupIngressInput{
+		GroupId: aws.String(a.sgID),
+		IpPermissions: []types.IpPermission{
+			{
+				IpRanges: []types.IpRange{{Description: aws.String(description)}},
+			},
+		},
+	})
+	if err != nil {
+		a.l.With(zap.Error(err)).Warnf("failed to revoke ingress for %s", description)
+	}
+}
@@ -17,9 +17,24 @@ import (
 )
 
 type ACLConfiguration struct {
-	CIDR          string `validate:"cidrv4,required"`
+	CIDR          string `validate:"omitempty,cidrv4"`
+	CIDRv6        string `validate:"omitempty,cidrv6"`
 	InternalPorts string `validate:"range,required"`
 	Deny          bool
+	// Protocol restricts the rule to tcp or udp; empty (or "any") matches
+	// both, same default as the rest of the rule's fields being "no
+	// restriction" when left unset.
+	Protocol string `validate:"omitempty,oneof=tcp udp any"`
+	// ExternalPorts, MaxLeasesPerClient and LeaseTTL apply only once this
+	// rule is chosen as the governing rule for a request (see
+	// ACLPolicy.Evaluate). MaxLeasesPerClient caps how many concurrent
+	// leases one client may hold under the rule and LeaseTTL overrides the
+	// granted lease lifetime; zero means "no override" for either.
+	// ExternalPorts is validated and parsed but not applied: the external
+	// port a matching client is handed is not restricted to it.
+	ExternalPorts      string `validate:"omitempty,range"`
+	MaxLeasesPerClient uint32
+	LeaseTTL           string `validate:"omitempty"`
 }
 type Configuration struct {
 	ACLAllowDefault       bool
@@ -27,6 +42,7 @@ type Configuration struct {
 	DataDir               string `validate:"dir,required"`
 	EBPFEnabled           bool
 	ExternalIP            string   `validate:"omitempty,ipv4"`
+	ExternalIP6           string   `validate:"omitempty,ipv6"`
 	ListenAddrs           []string `validate:"required,dive,hostname_port,min=1"`
 	LogFormat             string
 	LogLevel              string
@@ -37,6 +53,19 @@ type Configuration struct {
 	ReplicationListenAddr string `validate:"omitempty,hostname_port"`
 	ReplicationSecret     string
 	ReplicationPeers      []string
+	RaftListenAddr        string `validate:"omitempty,hostname_port"`
+	AdminListenAddr       string `validate:"omitempty,hostname_port"`
+	MetricsListenAddr     string `validate:"omitempty,hostname_port"`
+	LeaseLifetimeMin      uint32
+	LeaseLifetimeMax      uint32
+	// Backend picks the dataplane that makes an external port actually
+	// reachable: iptables/ip6tables locally, gce/aws for cloud VPC routing,
+	// or userspace proxying. EBPFEnabled is deliberately not one of these
+	// values - it's an accelerator layered on top of whichever Backend is
+	// chosen (see PortPublisher's doc comment in dataplane.go), not an
+	// alternative to it, so there is no "xdp" or "auto" here.
+	Backend   string `validate:"oneof=iptables gce aws userspace"`
+	NATPolicy string `validate:"omitempty,oneof=endpoint-independent address-restricted port-restricted symmetric"`
 }
 
 func NewRootCommand() *cobra.Command {
@@ -55,6 +84,7 @@ func NewRootCommand() *cobra.Command {
 	rootCmd.PersistentFlags().String("log-level", "INFO", "log level")
 	rootCmd.PersistentFlags().String("log-format", "json", "log format (plain/json)")
 	rootCmd.Flags().String("external-ip", "", "ip to report to client as external (default auto detect)")
+	rootCmd.Flags().String("external-ip6", "", "ipv6 to report to PCP clients as external (default none)")
 	rootCmd.Flags().StringSlice("listen-addrs", []string{}, "addresses to listen on for nat-pmp requests, needs to be actual ip")
 	rootCmd.Flags().StringSlice("no-nat-cidr", []string{}, "don't nat these cidr (max 10)")
 	rootCmd.Flags().Bool("create-chains", true, "create required chains")
@@ -64,6 +94,13 @@ func NewRootCommand() *cobra.Command {
 	rootCmd.Flags().String("port-range", "10000-19999", "external port range to allocate from")
 	rootCmd.Flags().String("replication-listen-addr", "", "enable and listen for replication requests")
 	rootCmd.Flags().StringSlice("replication-peers", []string{}, "peers to replicate with `x.x.x.x:8080`")
+	rootCmd.Flags().String("raft-listen-addr", "", "enable raft-consensus replication and listen for cluster traffic, peers are reused from replication-peers")
+	rootCmd.Flags().String("admin-listen-addr", "", "enable the non-NAT-PMP admin api used by dynport-cni for CHECK/GC")
+	rootCmd.Flags().String("metrics-listen-addr", "", "enable and expose Prometheus metrics on /metrics")
+	rootCmd.Flags().Uint32("lease-lifetime-min", 120, "minimum granted NAT-PMP/PCP lease lifetime in seconds (RFC 6886/6887)")
+	rootCmd.Flags().Uint32("lease-lifetime-max", 86400, "maximum granted NAT-PMP/PCP lease lifetime in seconds (RFC 6886/6887)")
+	rootCmd.Flags().String("backend", "iptables", "dataplane backend to publish ports with (iptables/gce/aws/userspace)")
+	rootCmd.Flags().String("nat-policy", "endpoint-independent", "NAT mapping behavior to emulate when allocating external ports (endpoint-independent/address-restricted/port-restricted/symmetric)")
 	return rootCmd
 }
 func initializeConfig(cmd *cobra.Command) error {
@@ -0,0 +1,231 @@
+// Command dynport-cni is a CNI IPAM/port-mapping plugin that reserves an
+// external port on a running dynport-server for each requested container
+// port, instead of requiring the container to speak NAT-PMP itself. It is
+// meant as a drop-in replacement for the reference "portmap" plugin.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/cni/pkg/version"
+	natpmp "github.com/jackpal/go-nat-pmp"
+)
+
+// portMapping mirrors the RuntimeConfig.PortMappings capability used by the
+// reference "portmap" plugin, so existing runtimes don't need any changes.
+type portMapping struct {
+	HostPort      int    `json:"hostPort"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol"`
+}
+
+type netConf struct {
+	types.NetConf
+	ServerAddr string `json:"serverAddr"` // host:port the dynport-server NAT-PMP/PCP listener is reachable on
+	AdminAddr  string `json:"adminAddr"`  // host:port of the dynport-server admin API, for CHECK/GC
+	Lifetime   int    `json:"lifetime"`   // requested lease lifetime in seconds, 0 = defaultLifetime; the server clamps it to its own range
+
+	RuntimeConfig struct {
+		PortMappings []portMapping `json:"portMappings,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+}
+
+func parseConf(stdin []byte) (*netConf, error) {
+	conf := &netConf{}
+	if err := json.Unmarshal(stdin, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse network configuration: %v", err)
+	}
+	if conf.ServerAddr == "" {
+		return nil, fmt.Errorf("serverAddr is required")
+	}
+	if err := version.ParsePrevResult(&conf.NetConf); err != nil {
+		return nil, fmt.Errorf("failed to parse prevResult: %v", err)
+	}
+	return conf, nil
+}
+
+// containerIP returns the first container address found in prevResult,
+// which dynport-server needs to key the lease it creates (and which the
+// admin API later uses to tag that lease with the container id).
+func containerIP(conf *netConf) (net.IP, error) {
+	if conf.PrevResult == nil {
+		return nil, fmt.Errorf("dynport-cni must run after an IPAM plugin has assigned an address")
+	}
+	prevResult, err := current.GetResult(conf.PrevResult)
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert prevResult: %v", err)
+	}
+	if len(prevResult.IPs) == 0 {
+		return nil, fmt.Errorf("no IP addresses found in prevResult")
+	}
+	return prevResult.IPs[0].Address.IP, nil
+}
+
+// defaultLifetime is the lifetime requested when the config leaves it unset,
+// the 7200 seconds RFC 6886 recommends for a mapping request.
+const defaultLifetime = 7200
+
+func natpmpProtocol(proto string) string {
+	if proto == "tcp" {
+		return "tcp"
+	}
+	return "udp"
+}
+
+func cmdAdd(args *skel.CmdArgs) error {
+	conf, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+
+	cip, err := containerIP(conf)
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(conf.ServerAddr)
+	if err != nil {
+		return fmt.Errorf("invalid serverAddr %q: %v", conf.ServerAddr, err)
+	}
+	gateway := net.ParseIP(host)
+	if gateway == nil {
+		return fmt.Errorf("invalid serverAddr host %q", host)
+	}
+
+	client := natpmp.NewClient(gateway)
+
+	// A NAT-PMP request with lifetime 0 deletes the mapping, so an unset
+	// lifetime is never sent as-is.
+	lifetime := conf.Lifetime
+	if lifetime == 0 {
+		lifetime = defaultLifetime
+	}
+
+	mapped := make([]portMapping, 0, len(conf.RuntimeConfig.PortMappings))
+	for _, pm := range conf.RuntimeConfig.PortMappings {
+		proto := natpmpProtocol(pm.Protocol)
+		res, err := client.AddPortMapping(proto, pm.ContainerPort, pm.HostPort, lifetime)
+		if err != nil {
+			return fmt.Errorf("failed to request mapping for container port %d: %v", pm.ContainerPort, err)
+		}
+
+		mapped = append(mapped, portMapping{
+			HostPort:      int(res.MappedExternalPort),
+			ContainerPort: pm.ContainerPort,
+			Protocol:      pm.Protocol,
+		})
+
+		if conf.AdminAddr != "" {
+			if err := tagLease(conf.AdminAddr, args.ContainerID, cip, proto, pm.ContainerPort); err != nil {
+				return fmt.Errorf("failed to tag lease with container id: %v", err)
+			}
+		}
+	}
+
+	prevResult, err := current.GetResult(conf.PrevResult)
+	if err != nil {
+		return err
+	}
+	prevResult.CNIVersion = conf.CNIVersion
+
+	// current.Result has no portMappings field of its own, so the assigned
+	// host ports are reported back the same way the reference "portmap"
+	// plugin does: as a runtimeConfig-shaped sibling field on the result,
+	// which callers that know to look for it can read directly instead of
+	// having to poll the admin API.
+	out := struct {
+		*current.Result
+		RuntimeConfig struct {
+			PortMappings []portMapping `json:"portMappings"`
+		} `json:"runtimeConfig"`
+	}{Result: prevResult}
+	out.RuntimeConfig.PortMappings = mapped
+
+	return json.NewEncoder(os.Stdout).Encode(out)
+}
+
+func cmdDel(args *skel.CmdArgs) error {
+	conf, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if conf.AdminAddr == "" {
+		return nil
+	}
+	req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf("http://%s/containers/%s/mappings", conf.AdminAddr, args.ContainerID), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to gc mappings for %s: %v", args.ContainerID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %d gc'ing mappings for %s", resp.StatusCode, args.ContainerID)
+	}
+	return nil
+}
+
+func cmdCheck(args *skel.CmdArgs) error {
+	conf, err := parseConf(args.StdinData)
+	if err != nil {
+		return err
+	}
+	if conf.AdminAddr == "" {
+		return nil
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/containers/%s/mappings", conf.AdminAddr, args.ContainerID))
+	if err != nil {
+		return fmt.Errorf("failed to check mappings for %s: %v", args.ContainerID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d checking mappings for %s", resp.StatusCode, args.ContainerID)
+	}
+	var leases []map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&leases); err != nil {
+		return err
+	}
+	if len(leases) != len(conf.RuntimeConfig.PortMappings) {
+		return fmt.Errorf("expected %d mappings for %s, found %d", len(conf.RuntimeConfig.PortMappings), args.ContainerID, len(leases))
+	}
+	return nil
+}
+
+// tagLease records which container owns a lease dynport-server just created
+// over NAT-PMP, keyed the same way the server itself looks leases up: by
+// client IP, internal port and protocol.
+func tagLease(adminAddr, containerID string, clientIP net.IP, protocol string, internalPort int) error {
+	u := fmt.Sprintf("http://%s/containers/%s/mappings?%s", adminAddr, containerID, url.Values{
+		"clientIP":     {clientIP.String()},
+		"internalPort": {fmt.Sprintf("%d", internalPort)},
+		"protocol":     {protocol},
+	}.Encode())
+
+	req, err := http.NewRequest(http.MethodPut, u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("unexpected status %d tagging lease", resp.StatusCode)
+	}
+	return nil
+}
+
+func main() {
+	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, "dynport-cni is a CNI plugin provisioning port mappings via dynport-server")
+}
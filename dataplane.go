@@ -0,0 +1,42 @@
+package main
+
+// PortPublisher is the dataplane abstraction the lease table is reconciled
+// against. IPTablesManager programs this instance's own iptables/ip6tables
+// NAT, which is all a bare-metal or plain-VM deployment needs. On a cloud
+// VM (GCE, AWS VPC) that's not enough: the instance's local NAT never sees
+// packets for an external port unless the cloud's own forwarding rule or
+// route table already points it here, so GCEBackend and AWSBackend instead
+// reconcile the cloud provider's routing to match the lease table.
+// UserspaceBackend trades both for portability: plain Go listeners that
+// proxy bytes instead of programming any kernel NAT, for platforms and
+// unprivileged containers (and CI) where neither iptables nor XDP is an
+// option. EBPFManager is the odd one out: it's not a Backend choice (it has
+// no entry in config.Backend's validator) but an accelerator layered on top
+// of whichever backend is chosen, toggled independently by config.EBPFEnabled
+// - it satisfies this interface so main's reconcile loop can treat it like
+// any other publisher instead of threading it through as a special case.
+type PortPublisher interface {
+	// EnsureMappings reconciles the dataplane to match exactly this set of
+	// active leases, adding what's missing and removing what's stale.
+	EnsureMappings(leases []*PortMappingLease)
+
+	// StartReconcile runs until Close is called, invoking
+	// EnsureMappings(leasesFn()) every 2 minutes and whenever Reconcile is
+	// called.
+	StartReconcile(leasesFn func() ([]*PortMappingLease, error))
+
+	// Reconcile asks a running StartReconcile loop to run now instead of
+	// waiting for the next tick.
+	Reconcile()
+
+	// Close stops a running StartReconcile loop.
+	Close()
+}
+
+var (
+	_ PortPublisher = (*IPTablesManager)(nil)
+	_ PortPublisher = (*GCEBackend)(nil)
+	_ PortPublisher = (*AWSBackend)(nil)
+	_ PortPublisher = (*UserspaceBackend)(nil)
+	_ PortPublisher = (*EBPFManager)(nil)
+)
@@ -1,17 +1,33 @@
 package main
 
 import (
-	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"github.com/timshannon/badgerhold"
 	"go.uber.org/zap"
-	"net"
+	"net/netip"
+	"sync"
 	"time"
 )
 
 type DataStore struct {
 	l     *zap.Logger
 	store *badgerhold.Store
+
+	// portRangeStart/End bound AllocateExternal's scan range (config's
+	// PortRange, "start-end" inclusive); portAllocMu serializes allocation
+	// so two concurrent AllocateExternal/ReleaseExternal calls can't race on
+	// the same family's port bitmap read-modify-write.
+	portRangeStart, portRangeEnd uint16
+	portAllocMu                  sync.Mutex
+
+	// origin identifies this node's writes in PortMappingLease.Origin, so a
+	// replication peer merging one of our records can break a Clock tie
+	// deterministically. start() sets it to ReplicationListenAddr, falling
+	// back to the hostname when replication isn't configured.
+	origin  string
+	clockMu sync.Mutex
 }
 type badgerLog struct {
 	zap.SugaredLogger
@@ -20,7 +36,7 @@ type badgerLog struct {
 func (b *badgerLog) Warningf(format string, args ...interface{}) {
 	b.Warnf(format, args...)
 }
-func NewDataStore(logger *zap.Logger, dataDir string) (*DataStore, error) {
+func NewDataStore(logger *zap.Logger, dataDir string, portRangeStart, portRangeEnd uint16, origin string) (*DataStore, error) {
 	options := badgerhold.DefaultOptions
 	options.Dir = dataDir
 	options.ValueDir = dataDir
@@ -31,16 +47,154 @@ func NewDataStore(logger *zap.Logger, dataDir string) (*DataStore, error) {
 		return nil, fmt.Errorf("failed to open badgerhold: %v", err)
 	}
 
-	return &DataStore{l: logger, store: store}, nil
+	d := &DataStore{l: logger, store: store, portRangeStart: portRangeStart, portRangeEnd: portRangeEnd, origin: origin}
+	if err := d.migrateLegacyLeaseIDs(); err != nil {
+		return nil, fmt.Errorf("failed to migrate legacy lease ids: %v", err)
+	}
+	if err := d.rebuildPortBitmaps(); err != nil {
+		return nil, fmt.Errorf("failed to rebuild port bitmaps: %v", err)
+	}
+
+	return d, nil
+}
+
+// legacyLeaseID records the rename of a lease created under the old,
+// collision-prone md5(proto || ip.String() || string(rune(port))) scheme to
+// its new leaseHash id, so an UpsertLease/DeleteLease a replication peer
+// still sends keyed by the old id (until that peer has migrated too) is
+// applied to the renamed record instead of being mistaken for a new lease.
+// Entries older than legacyLeaseIDGracePeriod are pruned by migrateLegacyLeaseIDs
+// on every subsequent open.
+type legacyLeaseID struct {
+	OldId      string `badgerhold:"unique"`
+	NewId      string
+	MigratedAt time.Time
+}
+
+const legacyLeaseIDGracePeriod = 7 * 24 * time.Hour
+
+// migrateLegacyLeaseIDs rehashes every lease still keyed by the old, lossy
+// leaseHash scheme (see leaseHash's doc comment) to the current one, leaving
+// a legacyLeaseID behind for the grace period so in-flight replication from
+// a peer that hasn't migrated yet still resolves. It also prunes
+// legacyLeaseID entries whose grace period has elapsed.
+func (d *DataStore) migrateLegacyLeaseIDs() error {
+	leases, err := d.GetLeases()
+	if err != nil {
+		return err
+	}
+	for _, lease := range leases {
+		newId := leaseHash(lease.Protocol, lease.ClientIP, lease.ClientPort)
+		if newId == lease.Id {
+			continue
+		}
+		oldId := lease.Id
+		lease.Id = newId
+		if err := d.store.Insert(newId, lease); err != nil && err != badgerhold.ErrKeyExists {
+			return fmt.Errorf("failed to insert migrated lease %s: %v", newId, err)
+		}
+		if err := d.store.Delete(oldId, &PortMappingLease{}); err != nil {
+			return fmt.Errorf("failed to delete legacy lease %s: %v", oldId, err)
+		}
+		if err := d.store.Insert(oldId, &legacyLeaseID{OldId: oldId, NewId: newId, MigratedAt: time.Now()}); err != nil && err != badgerhold.ErrKeyExists {
+			return fmt.Errorf("failed to record legacy lease id %s: %v", oldId, err)
+		}
+		d.l.Sugar().Infof("migrated legacy lease id %s to %s", oldId, newId)
+	}
+
+	var legacy []*legacyLeaseID
+	cutoff := time.Now().Add(-legacyLeaseIDGracePeriod)
+	if err := d.store.Find(&legacy, badgerhold.Where("MigratedAt").Lt(cutoff)); err != nil {
+		return err
+	}
+	for _, l := range legacy {
+		if err := d.store.Delete(l.OldId, &legacyLeaseID{}); err != nil {
+			return fmt.Errorf("failed to prune legacy lease id %s: %v", l.OldId, err)
+		}
+	}
+	return nil
+}
+
+// resolveLeaseID follows a legacyLeaseID rename if id is still one a peer on
+// the old hashing scheme might send, otherwise returns id unchanged.
+func (d *DataStore) resolveLeaseID(id string) string {
+	legacy := &legacyLeaseID{}
+	if err := d.store.Get(id, legacy); err == nil {
+		return legacy.NewId
+	}
+	return id
 }
 
 func (d *DataStore) Close() error {
 	return d.store.Close()
 }
 
+// lamportClock is this node's persisted Lamport clock, the monotonic
+// counter PortMappingLease.Clock is stamped with on every local write
+// (UpsertLease) and advanced past whenever a higher value arrives from a
+// peer (Merge), so a clock reset by a restart can never issue a value a
+// replica has already seen.
+type lamportClock struct {
+	Value uint64
+}
+
+const lamportClockKey = "lamportclock"
+
+// updateClock loads the persisted clock, replaces it with fn(current), and
+// persists the result, returning the new value.
+func (d *DataStore) updateClock(fn func(current uint64) uint64) uint64 {
+	d.clockMu.Lock()
+	defer d.clockMu.Unlock()
+
+	lc := &lamportClock{}
+	err := d.store.Get(lamportClockKey, lc)
+	if err != nil && err != badgerhold.ErrNotFound {
+		d.l.Sugar().With(zap.Error(err)).Warn("failed to load lamport clock")
+	}
+	lc.Value = fn(lc.Value)
+
+	if err == badgerhold.ErrNotFound {
+		if err := d.store.Insert(lamportClockKey, lc); err != nil {
+			d.l.Sugar().With(zap.Error(err)).Warn("failed to persist lamport clock")
+		}
+	} else if err := d.store.Update(lamportClockKey, lc); err != nil {
+		d.l.Sugar().With(zap.Error(err)).Warn("failed to persist lamport clock")
+	}
+	return lc.Value
+}
+
+func (d *DataStore) nextClock() uint64 {
+	return d.updateClock(func(current uint64) uint64 { return current + 1 })
+}
+
+// observeClock advances the persisted clock past remote without issuing a
+// new value of our own, the Lamport-clock rule for receiving a timestamped
+// message from a peer.
+func (d *DataStore) observeClock(remote uint64) {
+	d.updateClock(func(current uint64) uint64 {
+		if remote > current {
+			return remote
+		}
+		return current
+	})
+}
+
 func (d *DataStore) GetLeases() ([]*PortMappingLease, error) {
 	leases := make([]*PortMappingLease, 0)
-	err := d.store.Find(&leases, &badgerhold.Query{})
+	err := d.store.Find(&leases, badgerhold.Where("Deleted").Eq(false))
+	if err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// GetAllLeases returns every lease record, including delete tombstones
+// GetLeases filters out, for replication's anti-entropy digest/sync: a
+// delete that hasn't reached a peer yet needs to keep propagating as a
+// record, not disappear because GetLeases pretends it was never there.
+func (d *DataStore) GetAllLeases() ([]*PortMappingLease, error) {
+	leases := make([]*PortMappingLease, 0)
+	err := d.store.Find(&leases, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -51,14 +205,52 @@ func (d *DataStore) GetActiveLeases() ([]*PortMappingLease, error) {
 	after := time.Now().Add(-(5 * time.Minute))
 
 	leases := make([]*PortMappingLease, 0)
-	err := d.store.Find(&leases, badgerhold.Where("LastSeen").Ge(after))
+	err := d.store.Find(&leases, badgerhold.Where("LastSeen").Ge(after).And("Deleted").Eq(false))
+	if err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// GetExpiredLeases returns every live lease whose Expires has passed, for
+// the reaper to clean up. Leases with a zero Expires (created before
+// Lifetime/Expires existed) never show up here.
+func (d *DataStore) GetExpiredLeases() ([]*PortMappingLease, error) {
+	leases := make([]*PortMappingLease, 0)
+	err := d.store.Find(&leases, badgerhold.
+		Where("Expires").Gt(time.Time{}).
+		And("Expires").Le(time.Now()).
+		And("Deleted").Eq(false))
 	if err != nil {
 		return nil, err
 	}
 	return leases, nil
 }
 
+// UpsertLease creates or updates a lease this node itself is the source of
+// (a NAT-PMP/PCP request handled locally, or a raft-committed command - raft
+// already total-orders those, so LastSeen-wins is just "last applied wins").
+// It stamps Clock/Origin so a replication peer can later merge this record
+// with CRDT semantics; a record arriving *from* a peer should go through
+// Merge instead, since LastSeen is wall-clock time from whichever peer sent
+// it and isn't safe to compare across replicas with different clock skew.
+//
+// lease is the full, authoritative record - the caller already read it back
+// (or built it fresh for a new mapping), so an update replaces the stored
+// record wholesale rather than copying a handful of fields: a renewal's new
+// Lifetime/Expires, and any other change a caller made (ExternalPort,
+// Nonce, ContainerID, ...), must actually persist, not just the first
+// grant's. Only Created survives from the existing record, since it's
+// meant to stay fixed once a lease exists.
+//
+// A Deleted lease is kept as a tombstone rather than removed outright, so
+// that a full sync from a peer that missed the delete (and still offers the
+// old, live record) can't resurrect it: the tombstone's LastSeen wins the
+// same way any other update would.
 func (d *DataStore) UpsertLease(lease *PortMappingLease) error {
+	lease.Id = d.resolveLeaseID(lease.Id)
+	lease.Clock = d.nextClock()
+	lease.Origin = d.origin
 	leases := make([]*PortMappingLease, 0)
 	err := d.store.Find(&leases, badgerhold.Where("Id").Eq(lease.Id))
 	if err != nil {
@@ -70,23 +262,73 @@ func (d *DataStore) UpsertLease(lease *PortMappingLease) error {
 	if leases[0].LastSeen.After(lease.LastSeen) {
 		return nil
 	}
-	leases[0].LastSeen = lease.LastSeen
-	return d.store.Update(lease.Id, leases[0])
+	lease.Created = leases[0].Created
+	return d.store.Update(lease.Id, lease)
+}
+
+// Merge applies remote, a lease record received from a replication peer
+// (the gossip PUT handler or an anti-entropy pull), using CRDT semantics so
+// two replicas that independently updated the same lease during a
+// partition converge on the same value once they talk again: whichever
+// side has the higher Clock wins, and a tied Clock (both sides updated at
+// the same logical time) is broken by comparing Origin, so every replica
+// resolves the tie the same way regardless of which peer it heard from.
+func (d *DataStore) Merge(remote *PortMappingLease) error {
+	remote.Id = d.resolveLeaseID(remote.Id)
+	d.observeClock(remote.Clock)
+
+	local, err := d.GetLeaseById(remote.Id)
+	if err != nil {
+		return err
+	}
+	if local == nil {
+		return d.store.Insert(remote.Id, remote)
+	}
+	if !remoteWins(local, remote) {
+		return nil
+	}
+	return d.store.Update(remote.Id, remote)
+}
+
+// remoteWins implements Merge's CRDT order: higher Clock wins, a tie is
+// broken by comparing Origin so every replica picks the same side.
+func remoteWins(local, remote *PortMappingLease) bool {
+	if remote.Clock != local.Clock {
+		return remote.Clock > local.Clock
+	}
+	return remote.Origin > local.Origin
+}
+
+func (d *DataStore) DeleteLease(id string) error {
+	id = d.resolveLeaseID(id)
+	if lease, err := d.GetLeaseById(id); err == nil && lease != nil {
+		if err := d.ReleaseExternal(lease.AddressFamily, lease.ExternalPort, false); err != nil {
+			d.l.Sugar().With(zap.Error(err)).Warnf("failed to release external port %d for lease %s", lease.ExternalPort, id)
+		}
+	}
+	return d.store.Delete(id, &PortMappingLease{})
 }
 
 func (d *DataStore) GetLeaseById(id string) (*PortMappingLease, error) {
 	l := &PortMappingLease{}
-	err := d.store.Get(id, l)
-	return nil, err
+	err := d.store.Get(d.resolveLeaseID(id), l)
+	if err == badgerhold.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
 }
 
-func (d *DataStore) GetLeaseByIpAndPort(ip net.IP, port uint16, protocol PROTOCOL) (*PortMappingLease, error) {
+func (d *DataStore) GetLeaseByIpAndPort(ip netip.Addr, port uint16, protocol PROTOCOL) (*PortMappingLease, error) {
 	leases := make([]*PortMappingLease, 0)
 
 	err := d.store.Find(&leases, badgerhold.
 		Where("ClientIP").Eq(ip).
 		And("ClientPort").Eq(port).
-		And("Protocol").Eq(protocol))
+		And("Protocol").Eq(protocol).
+		And("Deleted").Eq(false))
 	if err != nil {
 		return nil, err
 	}
@@ -100,21 +342,63 @@ func (d *DataStore) GetLeaseByIpAndPort(ip net.IP, port uint16, protocol PROTOCO
 	return nil, fmt.Errorf("multiple lease matching found")
 }
 
-func (d *DataStore) IsExternalPortInUse(port uint16) bool {
+func (d *DataStore) GetLeasesByContainerID(containerID string) ([]*PortMappingLease, error) {
+	leases := make([]*PortMappingLease, 0)
+	err := d.store.Find(&leases, badgerhold.Where("ContainerID").Eq(containerID).And("Deleted").Eq(false))
+	if err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// GetActiveLeasesByClientIP returns every non-deleted lease held by ip, for
+// enforcing an ACLConfiguration.MaxLeasesPerClient cap.
+func (d *DataStore) GetActiveLeasesByClientIP(ip netip.Addr) ([]*PortMappingLease, error) {
 	leases := make([]*PortMappingLease, 0)
-	err := d.store.Find(&leases, badgerhold.Where("ExternalPort").Eq(port))
+	err := d.store.Find(&leases, badgerhold.Where("ClientIP").Eq(ip).And("Deleted").Eq(false))
+	if err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// IsExternalPortInUse reports whether port is already leased to a client of
+// the same address family as ip. v4 and v6 leases are reachable on two
+// different external addresses (externalIP/externalIP6), so the same port
+// number can be handed out to one of each at the same time.
+func (d *DataStore) IsExternalPortInUse(port uint16, ip netip.Addr) bool {
+	leases := make([]*PortMappingLease, 0)
+	err := d.store.Find(&leases, badgerhold.
+		Where("ExternalPort").Eq(port).
+		And("AddressFamily").Eq(addressFamilyOf(ip)).
+		And("Deleted").Eq(false))
 	if err != nil {
 		return true
 	}
 	return len(leases) > 0
 }
 
-func leaseHash(protocol PROTOCOL, clientIP net.IP, internalPort uint16) string {
-	data := make([]byte, 0)
-	data = append(data, []byte(protocol.String())...)
-	data = append(data, 0)
-	data = append(data, []byte(clientIP.To16().String())...)
+// leaseHash derives a lease's id from a stable binary layout of
+// proto || 0x00 || ip.As16() || big-endian port, so (ip, port, protocol)
+// collisions are only as likely as a SHA-256 collision. The legacy scheme
+// built its input with `[]byte(string(internalPort))`, which is the classic
+// Go bug of casting a uint16 straight to string: that produces the UTF-8
+// encoding of a rune, not two raw bytes, so ports 0-127 collapsed to a
+// single byte, ports >= 128 produced a variable number of bytes, and every
+// port in the UTF-16 surrogate range 0xD800-0xDFFF encoded to the same
+// UTF-8 replacement character - meaning different (ip, port) pairs could
+// (and did) hash to the same id.
+func leaseHash(protocol PROTOCOL, clientIP netip.Addr, internalPort uint16) string {
+	data := make([]byte, 0, 1+1+16+2)
+	if protocol == TCP {
+		data = append(data, 0)
+	} else {
+		data = append(data, 1)
+	}
 	data = append(data, 0)
-	data = append(data, []byte(string(internalPort))...)
-	return fmt.Sprintf("%x", md5.Sum(data))
+	ipBytes := clientIP.As16()
+	data = append(data, ipBytes[:]...)
+	data = binary.BigEndian.AppendUint16(data, internalPort)
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%x", sum)
 }
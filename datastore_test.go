@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/md5"
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// legacyLeaseHash mirrors the pre-SHA256 scheme leaseHash replaced: it casts
+// internalPort straight to a string instead of encoding it as two bytes,
+// which is the classic Go bug of treating a uint16 as a rune rather than a
+// number - see leaseHash's doc comment for why that collides.
+func legacyLeaseHash(protocol PROTOCOL, clientIP netip.Addr, internalPort uint16) string {
+	data := make([]byte, 0)
+	data = append(data, []byte(protocol.String())...)
+	data = append(data, 0)
+	data = append(data, []byte(clientIP.String())...)
+	data = append(data, 0)
+	data = append(data, []byte(string(rune(internalPort)))...)
+	return fmt.Sprintf("%x", md5.Sum(data))
+}
+
+// TestLeaseHash_FixesLegacySurrogateCollision demonstrates the collision
+// class legacyLeaseHash was vulnerable to: every port in the UTF-16
+// surrogate range (0xD800-0xDFFF) is an invalid rune, so Go's rune-to-string
+// conversion collapses all of them to the same replacement character, and
+// two otherwise distinct leases hashed to the same id.
+func TestLeaseHash_FixesLegacySurrogateCollision(t *testing.T) {
+	ip := netip.MustParseAddr("192.0.2.1")
+	portA := uint16(0xD800)
+	portB := uint16(0xDFFF)
+
+	if legacyLeaseHash(TCP, ip, portA) != legacyLeaseHash(TCP, ip, portB) {
+		t.Fatal("expected legacyLeaseHash to collide for surrogate-range ports, it didn't")
+	}
+
+	if leaseHash(TCP, ip, portA) == leaseHash(TCP, ip, portB) {
+		t.Fatal("leaseHash collided for distinct ports in the surrogate range")
+	}
+}
+
+// TestLeaseHash_Distinct checks the fixed-width binary layout leaseHash now
+// hashes over: protocol, IP and port each occupy a fixed number of bytes, so
+// varying any one of them alone can't produce the same input another
+// combination already produced.
+func TestLeaseHash_Distinct(t *testing.T) {
+	ip1 := netip.MustParseAddr("192.0.2.1")
+	ip2 := netip.MustParseAddr("192.0.2.2")
+
+	cases := []struct {
+		name     string
+		protocol PROTOCOL
+		ip       netip.Addr
+		port     uint16
+	}{
+		{"base", TCP, ip1, 80},
+		{"different protocol", UDP, ip1, 80},
+		{"different ip", TCP, ip2, 80},
+		{"different port", TCP, ip1, 81},
+	}
+
+	seen := make(map[string]string)
+	for _, c := range cases {
+		h := leaseHash(c.protocol, c.ip, c.port)
+		if other, ok := seen[h]; ok {
+			t.Fatalf("leaseHash(%s) collided with %s", c.name, other)
+		}
+		seen[h] = c.name
+	}
+}
+
+// TestMigrateLegacyLeaseIDs_RenamesAndResolves covers the rename/grace-period
+// path migrateLegacyLeaseIDs adds: a lease still keyed by the old,
+// collision-prone id is rehashed to the current leaseHash id on open, and a
+// legacyLeaseID record is left behind so a peer still sending the old id
+// (e.g. mid-rollout replication) resolves to the renamed record.
+func TestMigrateLegacyLeaseIDs_RenamesAndResolves(t *testing.T) {
+	dir := t.TempDir()
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	oldId := legacyLeaseHash(TCP, ip, 80)
+	newId := leaseHash(TCP, ip, 80)
+	if oldId == newId {
+		t.Fatal("test fixture needs old and new ids to differ")
+	}
+
+	d, err := NewDataStore(zap.NewNop(), dir, 10000, 19999, "test-node")
+	if err != nil {
+		t.Fatalf("failed to open datastore: %v", err)
+	}
+	lease := &PortMappingLease{
+		Id:         oldId,
+		ClientIP:   ip,
+		ClientPort: 80,
+		Protocol:   TCP,
+		LastSeen:   time.Now(),
+	}
+	if err := d.store.Insert(oldId, lease); err != nil {
+		t.Fatalf("failed to insert legacy-keyed lease: %v", err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatalf("failed to close datastore: %v", err)
+	}
+
+	d2, err := NewDataStore(zap.NewNop(), dir, 10000, 19999, "test-node")
+	if err != nil {
+		t.Fatalf("failed to reopen datastore: %v", err)
+	}
+	defer d2.Close()
+
+	migrated, err := d2.GetLeaseById(newId)
+	if err != nil {
+		t.Fatalf("GetLeaseById(newId): %v", err)
+	}
+	if migrated == nil {
+		t.Fatal("expected lease to have been migrated to the new id, found nothing")
+	}
+	if migrated.Id != newId {
+		t.Fatalf("expected migrated lease Id %s, got %s", newId, migrated.Id)
+	}
+
+	if resolved := d2.resolveLeaseID(oldId); resolved != newId {
+		t.Fatalf("resolveLeaseID(oldId) = %s, want %s", resolved, newId)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TestUpsertLease_RenewalPersistsMutableFields covers the bug the 30s reaper
+// (pcpserver.Server.reapOnce -> GetExpiredLeases) depended on being fixed:
+// renewing an existing lease must actually move its Expires out, and must
+// keep whatever else the caller changed (ExternalPort, Nonce, ContainerID),
+// not just LastSeen/Deleted/Clock/Origin.
+func TestUpsertLease_RenewalPersistsMutableFields(t *testing.T) {
+	d, err := NewDataStore(zap.NewNop(), t.TempDir(), 10000, 19999, "test-node")
+	if err != nil {
+		t.Fatalf("failed to open datastore: %v", err)
+	}
+	defer d.Close()
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	created := time.Now().Add(-time.Hour)
+	lease := &PortMappingLease{
+		Id:           leaseHash(TCP, ip, 80),
+		Created:      created,
+		LastSeen:     created,
+		ClientIP:     ip,
+		ClientPort:   80,
+		Protocol:     TCP,
+		ExternalPort: 12000,
+		Lifetime:     time.Minute,
+		Expires:      created.Add(time.Minute),
+	}
+	if err := d.UpsertLease(lease); err != nil {
+		t.Fatalf("initial UpsertLease: %v", err)
+	}
+
+	renewal := &PortMappingLease{
+		Id:           lease.Id,
+		Created:      created,
+		LastSeen:     time.Now(),
+		ClientIP:     ip,
+		ClientPort:   80,
+		Protocol:     TCP,
+		ExternalPort: 12000,
+		Lifetime:     time.Hour,
+		Expires:      time.Now().Add(time.Hour),
+		Nonce:        []byte("renewed"),
+		ContainerID:  "container-123",
+	}
+	if err := d.UpsertLease(renewal); err != nil {
+		t.Fatalf("renewal UpsertLease: %v", err)
+	}
+
+	stored, err := d.GetLeaseById(lease.Id)
+	if err != nil {
+		t.Fatalf("GetLeaseById: %v", err)
+	}
+	if stored == nil {
+		t.Fatal("lease disappeared after renewal")
+	}
+	if !stored.Expires.Equal(renewal.Expires) {
+		t.Fatalf("Expires not renewed: got %v, want %v", stored.Expires, renewal.Expires)
+	}
+	if stored.Lifetime != renewal.Lifetime {
+		t.Fatalf("Lifetime not renewed: got %v, want %v", stored.Lifetime, renewal.Lifetime)
+	}
+	if stored.ContainerID != "container-123" {
+		t.Fatalf("ContainerID not persisted: got %q", stored.ContainerID)
+	}
+	if string(stored.Nonce) != "renewed" {
+		t.Fatalf("Nonce not persisted: got %q", stored.Nonce)
+	}
+	if !stored.Created.Equal(created) {
+		t.Fatalf("Created should survive unchanged: got %v, want %v", stored.Created, created)
+	}
+
+	expired, err := d.GetExpiredLeases()
+	if err != nil {
+		t.Fatalf("GetExpiredLeases: %v", err)
+	}
+	for _, l := range expired {
+		if l.Id == lease.Id {
+			t.Fatal("renewed lease still shows up as expired at its original Expires")
+		}
+	}
+}
@@ -138,18 +138,45 @@ func (e *EBPFManager) Reconcile() {
 	e.reconcileCh <- true
 }
 
+// LeaseStats would return per-lease packet/byte counters from a PERCPU_ARRAY
+// map, but nat_forward.c only exposes the aggregate RxCnt counters surfaced
+// by xdpnatforward.GetStats today; per-lease accounting needs a new map key
+// (by lease id or by the source/destination key) added there first.
+func (e *EBPFManager) LeaseStats(_ string) (xdpnatforward.Stats, bool) {
+	return xdpnatforward.Stats{}, false
+}
+
 func (e *EBPFManager) EnsureMappings(leases []*PortMappingLease) {
 	sourceKeys := make(map[[6]byte]interface{})
 	destinationKeys := make(map[[6]byte]interface{})
 
 	for _, lease := range leases {
 		if lease.Protocol != UDP {
+			// The Sources/Destinations maps only rewrite addresses/ports; for
+			// TCP that's not enough on its own, since a rewritten packet also
+			// needs its checksum fixed up and its flow tracked (SYN/RST) so a
+			// connection established before a lease refresh keeps working.
+			// nat_forward.c doesn't do either yet, so installing a TCP lease
+			// here would just corrupt its checksum without buying it a real
+			// fast path. TCP stays on iptables until that program grows a
+			// TCP branch.
+			continue
+		}
+		if !lease.ClientIP.Is4() {
+			// v6 leases have no XDP fast path yet: natforwardRemappingMap's Ip
+			// field is a plain 32-bit uint, and adding a 128-bit counterpart
+			// plus an IPv6/ICMPv6-neighbor-discovery branch means changes to
+			// xdpnatforward/nat_forward.c, which isn't part of this tree (only
+			// the hand-written Go wrapper around its bpf2go output is). They
+			// fall back to iptables, same as any TCP lease does for
+			// connection tracking.
+			e.l.Debugf("skipping v6 lease %s for xdp", lease.Id)
 			continue
 		}
 		m := xdpnatforward.Mapping{
 			PublicIP:    e.externalIP,
 			PublicPort:  lease.ExternalPort,
-			PrivateIP:   lease.ClientIP,
+			PrivateIP:   net.IP(lease.ClientIP.AsSlice()),
 			PrivatePort: lease.ClientPort,
 		}
 		sourceKey, sourceMap, err := xdpnatforward.GetSource(m)
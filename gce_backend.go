@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"go.uber.org/zap"
+	compute "google.golang.org/api/compute/v1"
+)
+
+// forwardingRulePrefix namespaces every rule this backend owns, the same
+// role chain_port_mapping plays for IPTablesManager, so removeUsedChains'
+// equivalent here can tell "ours, now stale" apart from anything else in
+// the project.
+const forwardingRulePrefix = "dynport-"
+
+// GCEBackend is a PortPublisher that programs GCE forwarding rules on the
+// instance's own network interface instead of local iptables NAT, for
+// instances where the cloud's VPC routing - not the kernel's - is what
+// decides whether a packet for an external port ever reaches this host.
+// Patterned after flannel's GCEBackend: detect the instance via the
+// metadata service, then reconcile desired vs. actual via list+diff.
+type GCEBackend struct {
+	l       *zap.SugaredLogger
+	svc     *compute.Service
+	project string
+	zone    string
+	region  string
+	network string
+	// instanceSelfLink is the target the forwarding rules point traffic at;
+	// GCE forwarding rules target an instance, not a bare IP.
+	instanceSelfLink string
+	externalIP       net.IP
+
+	reconcileCh      chan interface{}
+	reconcileCloseCh chan interface{}
+}
+
+// NewGCEBackend detects the current instance's project, zone and network
+// from the metadata service (http://metadata.google.internal, reachable
+// only from inside GCE) and reports its current ephemeral/static external
+// IP the same way, so the PCP server can auto-discover externalIP when
+// this backend is active rather than requiring it be configured by hand.
+func NewGCEBackend(l *zap.Logger) (*GCEBackend, error) {
+	if !metadata.OnGCE() {
+		return nil, fmt.Errorf("gce backend selected but not running on GCE")
+	}
+
+	project, err := metadata.ProjectID()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get project id from metadata: %v", err)
+	}
+	zone, err := metadata.Zone()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get zone from metadata: %v", err)
+	}
+	region := zone[:strings.LastIndex(zone, "-")]
+	instance, err := metadata.InstanceName()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get instance name from metadata: %v", err)
+	}
+	network, err := metadata.Get("instance/network-interfaces/0/network")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get network from metadata: %v", err)
+	}
+	externalIPStr, err := metadata.ExternalIP()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get external ip from metadata: %v", err)
+	}
+
+	ctx := context.Background()
+	svc, err := compute.NewService(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create compute service: %v", err)
+	}
+
+	return &GCEBackend{
+		l:                l.Sugar(),
+		svc:              svc,
+		project:          project,
+		zone:             zone,
+		region:           region,
+		network:          network,
+		instanceSelfLink: fmt.Sprintf("https://www.googleapis.com/compute/v1/projects/%s/zones/%s/instances/%s", project, zone, instance),
+		externalIP:       net.ParseIP(externalIPStr),
+		reconcileCh:      make(chan interface{}),
+		reconcileCloseCh: make(chan interface{}),
+	}, nil
+}
+
+// ExternalIP reports the instance's external address as discovered from the
+// metadata service, for callers that auto-discover it instead of taking it
+// from config when a cloud backend is active.
+func (g *GCEBackend) ExternalIP() net.IP {
+	return g.externalIP
+}
+
+func (g *GCEBackend) StartReconcile(leasesFn func() ([]*PortMappingLease, error)) {
+	timer := time.NewTicker(2 * time.Minute)
+	reconcileFn := func() {
+		g.l.Debug("reconcile gce forwarding rules")
+		leases, err := leasesFn()
+		if err != nil {
+			return
+		}
+		g.EnsureMappings(leases)
+	}
+	for {
+		select {
+		case <-timer.C:
+			reconcileFn()
+		case <-g.reconcileCh:
+			reconcileFn()
+		case <-g.reconcileCloseCh:
+			return
+		}
+	}
+}
+
+func (g *GCEBackend) Close() {
+	g.reconcileCloseCh <- true
+}
+
+func (g *GCEBackend) Reconcile() {
+	g.reconcileCh <- true
+}
+
+func (g *GCEBackend) ruleName(lease *PortMappingLease) string {
+	return fmt.Sprintf("%s%s-%s-%d", forwardingRulePrefix, lease.Protocol.String(), strings.ToLower(lease.Id[:12]), lease.ExternalPort)
+}
+
+// EnsureMappings lists every forwarding rule this backend owns (by name
+// prefix) and diffs it against the desired set from leases, inserting what's
+// missing and deleting what's stale - the same list+diff reconcile
+// IPTablesManager does with chains, just against the GCE API instead.
+func (g *GCEBackend) EnsureMappings(leases []*PortMappingLease) {
+	existing, err := g.listOwnedRules()
+	if err != nil {
+		g.l.With(zap.Error(err)).Error("failed to list forwarding rules")
+		return
+	}
+
+	desired := make(map[string]*PortMappingLease, len(leases))
+	for _, lease := range leases {
+		if isIPv6(lease.ClientIP) {
+			// GCE forwarding rules in this backend only cover the instance's
+			// IPv4 network interface.
+			continue
+		}
+		desired[g.ruleName(lease)] = lease
+	}
+
+	for name := range existing {
+		if _, ok := desired[name]; !ok {
+			if err := g.deleteRule(name); err != nil {
+				g.l.With(zap.Error(err)).Warnf("failed to delete stale forwarding rule %s", name)
+			}
+		}
+	}
+	for name, lease := range desired {
+		if _, ok := existing[name]; ok {
+			continue
+		}
+		if err := g.insertRule(name, lease); err != nil {
+			g.l.With(zap.Error(err)).Warnf("failed to insert forwarding rule %s", name)
+		}
+	}
+}
+
+func (g *GCEBackend) listOwnedRules() (map[string]*compute.ForwardingRule, error) {
+	owned := make(map[string]*compute.ForwardingRule)
+	err := g.svc.ForwardingRules.List(g.project, g.region).
+		Filter(fmt.Sprintf("name eq \"%s.*\"", forwardingRulePrefix)).
+		Pages(context.Background(), func(page *compute.ForwardingRuleList) error {
+			for _, rule := range page.Items {
+				if strings.HasPrefix(rule.Name, forwardingRulePrefix) {
+					owned[rule.Name] = rule
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return owned, nil
+}
+
+func (g *GCEBackend) insertRule(name string, lease *PortMappingLease) error {
+	rule := &compute.ForwardingRule{
+		Name:                name,
+		IPAddress:           g.externalIP.String(),
+		IPProtocol:          strings.ToUpper(lease.Protocol.String()),
+		PortRange:           strconv.Itoa(int(lease.ExternalPort)),
+		Target:              g.instanceSelfLink,
+		Network:             g.network,
+		LoadBalancingScheme: "", // forwarding directly to the instance, not a balanced backend
+	}
+	_, err := g.svc.ForwardingRules.Insert(g.project, g.region, rule).Do()
+	return err
+}
+
+func (g *GCEBackend) deleteRule(name string) error {
+	_, err := g.svc.ForwardingRules.Delete(g.project, g.region, name).Do()
+	return err
+}
@@ -8,6 +8,7 @@ import (
 	"go.uber.org/zap"
 	"math/rand"
 	"net"
+	"net/netip"
 	"strconv"
 	"strings"
 	"time"
@@ -27,13 +28,27 @@ const (
 type IPTablesManager struct {
 	l                *zap.SugaredLogger
 	ipt              *iptables.IPTables
+	family           iptables.Protocol
 	reconcileCh      chan interface{}
 	reconcileCloseCh chan interface{}
-	externalIP       net.IP
+	externalIP       netip.Addr
 }
 
-func NewIPTablesManager(l *zap.Logger, externalIP net.IP) (*IPTablesManager, error) {
-	ipt, err := iptables.New(iptables.IPFamily(iptables.ProtocolIPv4))
+func NewIPTablesManager(l *zap.Logger, externalIP netip.Addr) (*IPTablesManager, error) {
+	return newIPTablesManager(l, externalIP, iptables.ProtocolIPv4)
+}
+
+// NewIP6TablesManager is the ip6tables counterpart of NewIPTablesManager. It
+// maintains the same port-mapping/-pre/-post chains as a separate plane
+// rather than folding v6 rules into the v4 ones, the same way Docker's
+// libnetwork keeps IPv4 and IPv6 NAT in parallel tables - it keeps ensureIn's
+// diffing untouched and lets the two managers be reconciled independently.
+func NewIP6TablesManager(l *zap.Logger, externalIP netip.Addr) (*IPTablesManager, error) {
+	return newIPTablesManager(l, externalIP, iptables.ProtocolIPv6)
+}
+
+func newIPTablesManager(l *zap.Logger, externalIP netip.Addr, family iptables.Protocol) (*IPTablesManager, error) {
+	ipt, err := iptables.New(iptables.IPFamily(family))
 	if err != nil {
 		return nil, fmt.Errorf("failed to create iptables instance, %v", err)
 	}
@@ -42,6 +57,7 @@ func NewIPTablesManager(l *zap.Logger, externalIP net.IP) (*IPTablesManager, err
 	return &IPTablesManager{
 		l:                l.Sugar(),
 		ipt:              ipt,
+		family:           family,
 		reconcileCh:      reconcileCh,
 		reconcileCloseCh: reconcileCloseCh,
 		externalIP:       externalIP,
@@ -142,17 +158,80 @@ func (i *IPTablesManager) jumpExist(table, chain, target string) (bool, error) {
 	return false, nil
 }
 
+// EnsureMappings only programs rules for leases whose client address matches
+// this manager's family, so a v4 and a v6 IPTablesManager can both reconcile
+// from the same full lease list without stepping on each other's chains.
 func (i *IPTablesManager) EnsureMappings(leases []*PortMappingLease) {
+	family := "v4"
+	if i.family == iptables.ProtocolIPv6 {
+		family = "v6"
+	}
+	start := time.Now()
+	defer func() {
+		iptablesReconcileDuration.WithLabelValues(family).Observe(time.Since(start).Seconds())
+	}()
+
+	var familyLeases []*PortMappingLease
+	for _, lease := range leases {
+		if isIPv6(lease.ClientIP) == (i.family == iptables.ProtocolIPv6) {
+			familyLeases = append(familyLeases, lease)
+		}
+	}
+
 	postFix := RandStringBytes(6)
-	i.ensureIn(table_filter, chain_port_mapping, postFix, leases, forwardRule)
-	i.ensureIn(table_nat, chain_port_mapping_prerouting, postFix, leases, preroutingRule)
-	i.ensureIn(table_nat, chain_port_mapping_postrouting, postFix, leases, i.postroutingRule)
+	if err := i.ensureIn(table_filter, chain_port_mapping, postFix, familyLeases, forwardRule); err != nil {
+		iptablesReconcileErrorsTotal.WithLabelValues(family).Inc()
+	}
+	if err := i.ensureIn(table_nat, chain_port_mapping_prerouting, postFix, familyLeases, preroutingRule); err != nil {
+		iptablesReconcileErrorsTotal.WithLabelValues(family).Inc()
+	}
+	if err := i.ensureIn(table_nat, chain_port_mapping_postrouting, postFix, familyLeases, i.postroutingRule); err != nil {
+		iptablesReconcileErrorsTotal.WithLabelValues(family).Inc()
+	}
+}
+
+func isIPv6(ip netip.Addr) bool {
+	return ip.Is6() && !ip.Is4In6()
+}
+
+func hostCIDR(ip netip.Addr) string {
+	if isIPv6(ip) {
+		return fmt.Sprintf("%s/128", ip.String())
+	}
+	return fmt.Sprintf("%s/32", ip.String())
+}
+
+func hostPort(ip netip.Addr, port uint16) string {
+	if isIPv6(ip) {
+		return fmt.Sprintf("[%s]:%d", ip.String(), port)
+	}
+	return fmt.Sprintf("%s:%d", ip.String(), port)
+}
+
+// addrFromNetIP converts a stdlib net.IP (as returned by net.ParseIP, a
+// net.UDPAddr/TCPAddr, or other legacy net APIs) into the netip.Addr used
+// throughout the lease/dataplane plumbing, unmapping v4-in-v6 addresses so
+// a v4 client is always represented as netip.Addr.Is4, matching what
+// isIPv6/hostCIDR/hostPort expect. Returns the zero Addr for a nil/invalid
+// input.
+func addrFromNetIP(ip net.IP) netip.Addr {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}
+	}
+	return addr.Unmap()
+}
 
+// addrToV6Bytes renders addr as its 16-byte on-the-wire form (v4-in-v6
+// mapped for a v4 address), for protocols like PCP that always encode the
+// address field as 16 bytes regardless of family.
+func addrToV6Bytes(addr netip.Addr) [16]byte {
+	return addr.As16()
 }
 
 func forwardRule(lease *PortMappingLease) []string {
 	return []string{
-		"-d", fmt.Sprintf("%s/32", lease.ClientIP.String()),
+		"-d", hostCIDR(lease.ClientIP),
 		"-p", lease.Protocol.String(),
 		"-m", lease.Protocol.String(), "--dport", strconv.Itoa(int(lease.ClientPort)),
 		"-m", "comment", "--comment", lease.Id,
@@ -165,17 +244,17 @@ func preroutingRule(lease *PortMappingLease) []string {
 		"-p", lease.Protocol.String(),
 		"-m", lease.Protocol.String(), "--dport", strconv.Itoa(int(lease.ExternalPort)),
 		"-m", "comment", "--comment", lease.Id,
-		"-j", "DNAT", "--to-destination", fmt.Sprintf("%s:%d", lease.ClientIP, lease.ClientPort),
+		"-j", "DNAT", "--to-destination", hostPort(lease.ClientIP, lease.ClientPort),
 	}
 }
 
 func (i *IPTablesManager) postroutingRule(lease *PortMappingLease) []string {
 	return []string{
-		"-s", fmt.Sprintf("%s/32", lease.ClientIP.String()),
+		"-s", hostCIDR(lease.ClientIP),
 		"-p", lease.Protocol.String(),
 		"-m", lease.Protocol.String(), "--sport", strconv.Itoa(int(lease.ClientPort)),
 		"-m", "comment", "--comment", lease.Id,
-		"-j", "SNAT", "--to-source", fmt.Sprintf("%s:%d", i.externalIP.To4().String(), lease.ExternalPort),
+		"-j", "SNAT", "--to-source", hostPort(i.externalIP, lease.ExternalPort),
 	}
 }
 
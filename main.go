@@ -1,9 +1,12 @@
 package main
 
 import (
+	"dynport-server/pcpserver"
+	"encoding/json"
 	"fmt"
 	"go.uber.org/zap"
 	"net"
+	"net/netip"
 	"os"
 	"os/signal"
 	"syscall"
@@ -27,14 +30,107 @@ func (p PROTOCOL) String() string {
 	return ""
 }
 
+// AddressFamily records whether a lease's ClientIP is v4 or v6, so
+// ExternalPort uniqueness (IsExternalPortInUse) can be scoped per family:
+// the same external port number may be handed out to one v4 and one v6
+// lease at the same time, since they're reachable on two different
+// externalIP/externalIP6 addresses.
+type AddressFamily uint8
+
+const (
+	IPv4 AddressFamily = 0
+	IPv6 AddressFamily = 1
+)
+
+func (f AddressFamily) String() string {
+	if f == IPv6 {
+		return "v6"
+	}
+	return "v4"
+}
+
+func addressFamilyOf(ip netip.Addr) AddressFamily {
+	if isIPv6(ip) {
+		return IPv6
+	}
+	return IPv4
+}
+
 type PortMappingLease struct {
-	Id           string `badgerhold:"unique"`
-	Created      time.Time
-	LastSeen     time.Time
-	ClientIP     net.IP
-	ClientPort   uint16
-	Protocol     PROTOCOL
-	ExternalPort uint16 `badgerhold:"unique"`
+	Id            string `badgerhold:"unique"`
+	Created       time.Time
+	LastSeen      time.Time
+	ClientIP      netip.Addr
+	ClientPort    uint16
+	Protocol      PROTOCOL
+	AddressFamily AddressFamily `badgerhold:"index"`
+	ExternalPort  uint16        `badgerhold:"unique"`
+
+	// Lifetime is the granted (post-clamp) lease duration and Expires is
+	// when it lapses; both are zero for leases created before this field
+	// existed, which the reaper treats as never-expiring.
+	Lifetime time.Duration
+	Expires  time.Time `badgerhold:"index"`
+
+	// Clock and Origin make this record a CRDT: every local write bumps
+	// Clock past any value this node has seen (a Lamport clock, see
+	// DataStore.nextClock), and Origin records which node made it. Merging
+	// a record from a replication peer (DataStore.Merge) picks whichever
+	// side has the higher Clock, breaking a tie by comparing Origin, so
+	// every replica converges on the same winner regardless of wall-clock
+	// skew between peers - unlike LastSeen, which UpsertLease still uses
+	// for the local-write path where "same process, strictly increasing
+	// time" actually holds.
+	Clock  uint64
+	Origin string
+
+	// PCP-specific fields (RFC 6887), left zero for plain NAT-PMP leases.
+	Nonce       []byte     // 96-bit mapping nonce, used to authenticate renew/delete from the owning client
+	PCPClientIP netip.Addr // PCP client address from the request header, may differ from the UDP source when THIRD_PARTY is used
+
+	// ContainerID is an opaque identifier set by the dynport-cni plugin so it
+	// can later find and reap every lease belonging to a container. Left
+	// empty for leases created directly by a NAT-PMP/PCP client.
+	ContainerID string
+
+	// Deleted marks this record as a tombstone: a delete that a peer learned
+	// about over the replication PUT endpoint, kept around (instead of
+	// removed outright) so a later full sync of a peer that missed the
+	// delete can't resurrect it. Ignored everywhere leases are read back out
+	// (GetLeases and friends), except by UpsertLease itself.
+	Deleted bool
+}
+
+// UnmarshalJSON accepts both netip.Addr's own text encoding and the legacy
+// net.IP encoding ClientIP/PCPClientIP used before the netip.Addr migration
+// (net.IP.MarshalText produces the same canonical address string, or
+// "null"/absent for a nil/zero address), so a peer still replicating the old
+// format keeps working against one that's already rolled forward.
+func (l *PortMappingLease) UnmarshalJSON(data []byte) error {
+	type alias PortMappingLease
+	aux := &struct {
+		ClientIP    *string
+		PCPClientIP *string
+		*alias
+	}{alias: (*alias)(l)}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+	if aux.ClientIP != nil && *aux.ClientIP != "" {
+		addr, err := netip.ParseAddr(*aux.ClientIP)
+		if err != nil {
+			return fmt.Errorf("invalid ClientIP %q: %v", *aux.ClientIP, err)
+		}
+		l.ClientIP = addr
+	}
+	if aux.PCPClientIP != nil && *aux.PCPClientIP != "" {
+		addr, err := netip.ParseAddr(*aux.PCPClientIP)
+		if err != nil {
+			return fmt.Errorf("invalid PCPClientIP %q: %v", *aux.PCPClientIP, err)
+		}
+		l.PCPClientIP = addr
+	}
+	return nil
 }
 
 var config Configuration
@@ -58,18 +154,92 @@ func start() {
 	var externalIP net.IP
 	if config.ExternalIP != "" {
 		externalIP = net.ParseIP(config.ExternalIP)
-	} else {
-		externalIP, err = GetOutboundIP()
+	}
+
+	var externalIP6 net.IP
+	if config.ExternalIP6 != "" {
+		externalIP6 = net.ParseIP(config.ExternalIP6)
+	}
+
+	// publishers holds whichever dataplane(s) actually publish ports for the
+	// configured backend: iptables/ip6tables on bare metal or a plain VM, or
+	// a single cloud backend whose own VPC routing is what makes a port
+	// reachable at all, plus the XDP fast path (config.EBPFEnabled), which
+	// is additive rather than a Backend choice of its own and is appended
+	// below once it's constructed. reconcileDataplane fans out to all of
+	// them.
+	var publishers []PortPublisher
+	var ipt, ipt6 *IPTablesManager
+
+	switch config.Backend {
+	case "gce":
+		gceBackend, err := NewGCEBackend(logger)
 		if err != nil {
-			logger.With(zap.Error(err)).Fatal("failed to guess external ip")
+			logger.With(zap.Error(err)).Fatal("failed to create GCEBackend")
+		}
+		if externalIP == nil {
+			externalIP = gceBackend.ExternalIP()
+		}
+		defer gceBackend.Close()
+		publishers = append(publishers, gceBackend)
+	case "aws":
+		awsBackend, err := NewAWSBackend(logger)
+		if err != nil {
+			logger.With(zap.Error(err)).Fatal("failed to create AWSBackend")
+		}
+		if externalIP == nil {
+			externalIP = awsBackend.ExternalIP()
+		}
+		defer awsBackend.Close()
+		publishers = append(publishers, awsBackend)
+	case "userspace":
+		// No kernel NAT or special capability needed, so externalIP still
+		// needs guessing the same way the iptables default path does.
+		if externalIP == nil {
+			externalIP, err = GetOutboundIP()
+			if err != nil {
+				logger.With(zap.Error(err)).Fatal("failed to guess external ip")
+			}
+		}
+		userspaceBackend, err := NewUserspaceBackend(logger)
+		if err != nil {
+			logger.With(zap.Error(err)).Fatal("failed to create UserspaceBackend")
+		}
+		defer userspaceBackend.Close()
+		publishers = append(publishers, userspaceBackend)
+	default:
+		if externalIP == nil {
+			externalIP, err = GetOutboundIP()
+			if err != nil {
+				logger.With(zap.Error(err)).Fatal("failed to guess external ip")
+			}
 		}
-	}
 
-	ipt, err := NewIPTablesManager(logger, externalIP)
-	if err != nil {
-		logger.With(zap.Error(err)).Fatal("failed to create IPTablesManager")
+		ipt, err = NewIPTablesManager(logger, addrFromNetIP(externalIP))
+		if err != nil {
+			logger.With(zap.Error(err)).Fatal("failed to create IPTablesManager")
+		}
+		defer ipt.Close()
+		publishers = append(publishers, ipt)
+
+		if externalIP6 != nil {
+			ipt6, err = NewIP6TablesManager(logger, addrFromNetIP(externalIP6))
+			if err != nil {
+				logger.With(zap.Error(err)).Fatal("failed to create IP6TablesManager")
+			}
+			defer ipt6.Close()
+			publishers = append(publishers, ipt6)
+		}
+
+		if err = ipt.CheckPrerequisite(config.CreateChains, config.SkipJumpCheck); err != nil {
+			logger.With(zap.Error(err)).Fatal("prerequisite check failed")
+		}
+		if ipt6 != nil {
+			if err = ipt6.CheckPrerequisite(config.CreateChains, config.SkipJumpCheck); err != nil {
+				logger.With(zap.Error(err)).Fatal("prerequisite check failed")
+			}
+		}
 	}
-	defer ipt.Close()
 
 	ebpfManager, err := NewEBPFManager(logger, externalIP, config.EBPFEnabled, config.ListenAddrs)
 	if err != nil {
@@ -81,63 +251,131 @@ func start() {
 		ebpfManager.Close()
 		logger.With(zap.Error(err)).Fatal("failed to load EBPFManager")
 	}
+	// The XDP fast path is additive rather than a Backend choice of its own
+	// (config.EBPFEnabled toggles it independently of config.Backend), but
+	// it reconciles the exact same way any other publisher does, so it's
+	// just another entry in publishers rather than a parallel set of calls.
+	publishers = append(publishers, ebpfManager)
 
-	if err = ipt.CheckPrerequisite(config.CreateChains, config.SkipJumpCheck); err != nil {
-		logger.With(zap.Error(err)).Fatal("prerequisite check failed")
+	portRangeStart, portRangeEnd, err := parsePortRange(config.PortRange)
+	if err != nil {
+		logger.With(zap.Error(err)).Fatal("invalid port-range")
 	}
-
-	store, err := NewDataStore(logger, config.DataDir)
+	origin := config.ReplicationListenAddr
+	if origin == "" {
+		origin, err = os.Hostname()
+		if err != nil {
+			logger.With(zap.Error(err)).Fatal("failed to determine hostname for datastore origin")
+		}
+	}
+	store, err := NewDataStore(logger, config.DataDir, portRangeStart, portRangeEnd, origin)
 	if err != nil {
 		logger.With(zap.Error(err)).Fatal("failed to start datastore")
 	}
 	defer store.Close()
 
-	go ipt.StartReconcile(store.GetActiveLeases)
-	go ebpfManager.StartReconcile(store.GetActiveLeases)
+	natPolicy, err := ParseNATPolicy(config.NATPolicy)
+	if err != nil {
+		logger.With(zap.Error(err)).Fatal("invalid nat-policy")
+	}
+
+	for _, publisher := range publishers {
+		go publisher.StartReconcile(store.GetActiveLeases)
+	}
+
+	for _, publisher := range publishers {
+		go publisher.Reconcile()
+	}
+
+	// reconcileDataplane signals every configured publisher to recompute its
+	// rules from the current lease set; it's the single hook registered
+	// wherever a lease change can occur.
+	reconcileDataplane := func() {
+		for _, publisher := range publishers {
+			publisher.Reconcile()
+		}
+		UpdateLeaseGauges(store)
+	}
 
-	go ipt.Reconcile()
-	go ebpfManager.Reconcile()
+	metricsServer := NewMetricsServer(logger, config.MetricsListenAddr)
+	metricsServer.Start()
 
 	replication := NewReplication(logger, store, config.ReplicationListenAddr, config.ReplicationSecret, config.ReplicationPeers)
-	replication.RegisterUpdateListener(ipt.Reconcile)
-	replication.RegisterUpdateListener(ebpfManager.Reconcile)
+	replication.RegisterUpdateListener(reconcileDataplane)
+
+	var raftRepl *RaftReplication
+	if config.RaftListenAddr != "" {
+		if config.ReplicationSecret == "" {
+			logger.Fatal("you have enabled raft replication, but not specified a replication secret")
+		}
+		raftRepl, err = NewRaftReplication(logger, store, config.DataDir, config.RaftListenAddr, config.ReplicationPeers, config.ReplicationSecret, reconcileDataplane)
+		if err != nil {
+			logger.With(zap.Error(err)).Fatal("failed to start raft replication")
+		}
+		defer raftRepl.Shutdown()
+		replication.RegisterRaftAdmin(raftRepl)
+	}
+
 	replication.Start()
 
-	go func() {
-		replication.RunFullSync()
+	if raftRepl == nil {
+		// RunAntiEntropy already no-ops once raft is enabled (see
+		// Replication.raft), but there's no point ticking forever just to
+		// hit that no-op when we already know raft took over at startup.
+		go func() {
+			replication.RunAntiEntropy()
 
-		t := time.NewTimer(5 * time.Minute)
-		for {
-			select {
-			case <-t.C:
-				replication.RunFullSync()
+			ticker := time.NewTicker(5 * time.Minute)
+			defer ticker.Stop()
+			for range ticker.C {
+				replication.RunAntiEntropy()
 			}
-		}
-	}()
+		}()
+	}
 
-	dynPortServer, err := NewDynPortServer(logger, store, config.ListenAddrs, externalIP, config.ACL, config.ACLAllowDefault)
-	if err != nil {
-		logger.With(zap.Error(err)).Fatal("failed to create new dynPortServer server")
+	adminServer := NewAdminServer(logger, store, config.AdminListenAddr)
+	adminServer.RegisterUpdateListener(reconcileDataplane)
+	adminServer.Start()
+
+	listenAddr := config.ListenAddrs[0]
+	if len(config.ListenAddrs) > 1 {
+		logger.Sugar().Warnf("pcpserver only binds a single address, ignoring %v and listening on %s", config.ListenAddrs[1:], listenAddr)
 	}
 
+	var acl aclPolicyHolder
+	acl.set(logger.Sugar(), config.ACL, config.ACLAllowDefault)
+	WatchSIGHUP(logger.Sugar(), func() {
+		acl.set(logger.Sugar(), config.ACL, config.ACLAllowDefault)
+	})
+
+	pcpSrv := pcpserver.New(logger, &pcpServerStore{store: store, raft: raftRepl, natPolicy: natPolicy}, pcpserver.Config{
+		ListenAddr:  listenAddr,
+		ExternalIP:  addrFromNetIP(externalIP),
+		ExternalIP6: addrFromNetIP(externalIP6),
+		MinLifetime: config.LeaseLifetimeMin,
+		MaxLifetime: config.LeaseLifetimeMax,
+		ACL:         aclCheckerFor(&acl),
+	})
+
 	signalChannel := make(chan os.Signal)
 	signal.Notify(signalChannel, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		select {
 		case <-signalChannel:
 			logger.Info("shutting down")
-			dynPortServer.Stop()
+			pcpSrv.Stop()
 		}
 	}()
 
-	dynPortServer.RegisterListener(func(_ PortMappingLease) {
-		go ipt.Reconcile()
-		go ebpfManager.Reconcile()
+	pcpSrv.RegisterListener(func(_ pcpserver.Lease) {
+		go reconcileDataplane()
+	})
+	pcpSrv.RegisterListener(func(lease pcpserver.Lease) {
+		replication.PortMappingLeaseListener(*pcpLeaseToPortMappingLease(lease))
 	})
-	dynPortServer.RegisterListener(replication.PortMappingLeaseListener)
-	err = dynPortServer.Start()
+	err = pcpSrv.Start()
 	if err != nil {
-		logger.With(zap.Error(err)).Error("failed to start dynPortServer server")
+		logger.With(zap.Error(err)).Error("failed to start pcpserver server")
 	}
 }
 
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// pcpRequestsTotal and pcpRequestDuration are registered, so /metrics exports
+// them, but nothing in this module records into them: pcpserver.Server has no
+// per-request hook, and both stay at zero.
+var (
+	pcpRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pcp_requests_total",
+		Help: "Total NAT-PMP/PCP requests handled, by request kind and outcome.",
+	}, []string{"op", "result_code"})
+
+	pcpRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pcp_request_duration_seconds",
+		Help:    "Time to handle a NAT-PMP/PCP request, by request kind.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"op"})
+
+	leasesTotal = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "leases_total",
+		Help: "Current number of active leases, by protocol.",
+	}, []string{"protocol"})
+
+	externalPortsInUse = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "external_ports_in_use",
+		Help: "Current number of external ports handed out across all leases.",
+	})
+
+	iptablesReconcileDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "iptables_reconcile_duration_seconds",
+		Help:    "Time to reconcile the iptables/ip6tables port-mapping chains against the lease table.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"family"})
+
+	iptablesReconcileErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "iptables_reconcile_errors_total",
+		Help: "Total errors encountered while reconciling the iptables/ip6tables port-mapping chains.",
+	}, []string{"family"})
+
+	replicationPeerSyncFailuresTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "replication_peer_sync_failures_total",
+		Help: "Total failures talking to a replication peer, by peer address.",
+	}, []string{"peer"})
+
+	userspaceReconcileDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "userspace_reconcile_duration_seconds",
+		Help:    "Time to reconcile the userspace proxy dataplane against the lease table.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	userspaceActiveProxies = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "userspace_active_proxies",
+		Help: "Current number of external ports proxied by the userspace dataplane.",
+	})
+
+	userspaceProxyErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "userspace_proxy_errors_total",
+		Help: "Total errors starting a userspace proxy for a lease.",
+	})
+)
+
+// MetricsServer exposes /metrics on its own listener rather than being
+// mounted on the replication or admin gin engines, so a Prometheus scraper
+// doesn't need the replication basic-auth secret or the admin API's trust
+// boundary.
+type MetricsServer struct {
+	l          *zap.Logger
+	listenAddr string
+}
+
+func NewMetricsServer(l *zap.Logger, listenAddr string) *MetricsServer {
+	return &MetricsServer{l: l, listenAddr: listenAddr}
+}
+
+func (m *MetricsServer) Start() {
+	if m.listenAddr == "" {
+		m.l.Sugar().Info("metrics is not enabled")
+		return
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	go func() {
+		if err := http.ListenAndServe(m.listenAddr, mux); err != nil {
+			m.l.With(zap.Error(err)).Error("failed to start metrics server")
+		}
+	}()
+}
+
+// UpdateLeaseGauges refreshes leases_total and external_ports_in_use from
+// the current lease table. It's cheap enough to call from reconcileDataplane
+// alongside the dataplane publishers, which is already the "something
+// changed" signal used everywhere else.
+func UpdateLeaseGauges(store *DataStore) {
+	leases, err := store.GetLeases()
+	if err != nil {
+		return
+	}
+	var tcp, udp float64
+	for _, lease := range leases {
+		if lease.Protocol == TCP {
+			tcp++
+		} else {
+			udp++
+		}
+	}
+	leasesTotal.WithLabelValues("tcp").Set(tcp)
+	leasesTotal.WithLabelValues("udp").Set(udp)
+	externalPortsInUse.Set(tcp + udp)
+}
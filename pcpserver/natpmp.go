@@ -0,0 +1,144 @@
+package pcpserver
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// NAT-PMP (RFC 6886) v0 handling, on the same socket(s) as the PCP v2
+// handling in pcp.go.
+
+func (s *Server) handleNATPMPRequest(conn net.PacketConn, addr net.Addr, buf []byte) error {
+	if len(buf) < 2 {
+		s.responseWithNATPMPErrorResultCode(conn, addr, 5)
+		return nil
+	}
+	switch buf[1] {
+	case 0:
+		return s.handleNATPMPExternalAddressRequest(conn, addr)
+	case 1: // UDP mapping request
+		return s.handleNATPMPMappingRequest(conn, 1, addr, buf[4:])
+	case 2: // TCP mapping request
+		return s.handleNATPMPMappingRequest(conn, 2, addr, buf[4:])
+	default:
+		s.responseWithNATPMPErrorResultCode(conn, addr, 5)
+		return fmt.Errorf("operation not implemented")
+	}
+}
+
+func (s *Server) responseWithNATPMPErrorResultCode(conn net.PacketConn, addr net.Addr, code uint16) {
+	res := make([]byte, 8)
+	writeUint16(res[2:4], code)
+	writeUint32(res[4:8], uint32(time.Now().Unix()-s.started.Unix()))
+	if conn != nil {
+		conn.WriteTo(res, addr)
+	}
+}
+
+func (s *Server) handleNATPMPExternalAddressRequest(conn net.PacketConn, addr net.Addr) error {
+	res := make([]byte, 12)
+	res[1] = 128 // Response op code
+	writeUint32(res[4:8], uint32(time.Now().Unix()-s.started.Unix()))
+	if s.cfg.ExternalIP.Is4() {
+		b := s.cfg.ExternalIP.As4()
+		copy(res[8:12], b[:])
+	}
+	if conn != nil {
+		_, err := conn.WriteTo(res, addr)
+		return err
+	}
+	return nil
+}
+
+func (s *Server) handleNATPMPMappingRequest(conn net.PacketConn, op byte, addr net.Addr, buf []byte) error {
+	internalPort := readUint16(buf[0:2])
+	externalPort := readUint16(buf[2:4])
+	requestLifetime := readUint32(buf[4:8])
+
+	clientIP := clientAddrFromAddr(addr)
+	protocol, _ := protocolName(op)
+
+	resultCode := uint16(0)
+	lifetime := s.clampLifetime(requestLifetime)
+
+	decision := s.checkACL(clientIP, protocol, internalPort)
+	if decision.LeaseTTL > 0 {
+		lifetime = s.clampLifetime(uint32(decision.LeaseTTL / time.Second))
+	}
+
+	if !decision.Allowed {
+		resultCode = 2 // Not Authorized/Refused, RFC 6886 §3.5.
+		externalPort = 0
+		lifetime = 0
+	} else if requestLifetime == 0 {
+		// Lifetime 0 is NAT-PMP's explicit delete, not "use the default".
+		lease, err := s.store.GetLeaseByIpAndPort(clientIP, internalPort, protocol)
+		if err != nil {
+			resultCode = 3
+		} else if lease != nil {
+			if err := s.store.DeleteLease(lease.ID); err != nil {
+				resultCode = 3
+			} else {
+				s.notify(*lease)
+			}
+		}
+		externalPort = 0
+		lifetime = 0
+	} else {
+		lease, err := s.store.GetLeaseByIpAndPort(clientIP, internalPort, protocol)
+		if err != nil {
+			return fmt.Errorf("error getting existing lease %v", err)
+		}
+		atCap := false
+		if lease == nil {
+			atCap, err = s.atClientLeaseCap(clientIP, decision)
+			if err != nil {
+				return fmt.Errorf("error counting active leases %v", err)
+			}
+		}
+		if atCap {
+			resultCode = 4 // Insufficient Resources, RFC 6886 §3.5.
+			externalPort = 0
+			lifetime = 0
+		} else {
+			if lease == nil {
+				externalPort, err = s.store.AllocateExternal(clientIP, protocol, internalPort)
+				if err != nil {
+					resultCode = 4
+				} else {
+					lease = &Lease{
+						ClientIP:     clientIP,
+						ClientPort:   internalPort,
+						Protocol:     protocol,
+						ExternalPort: externalPort,
+					}
+				}
+			}
+			if resultCode == 0 {
+				lease.LastSeen = time.Now()
+				lease.Lifetime = time.Duration(lifetime) * time.Second
+				lease.Expires = lease.LastSeen.Add(lease.Lifetime)
+				if err := s.store.UpsertLease(lease); err != nil {
+					return fmt.Errorf("failed to upsert new lease %v", err)
+				}
+				externalPort = lease.ExternalPort
+				s.notify(*lease)
+				s.triggerReap()
+			}
+		}
+	}
+
+	res := make([]byte, 16)
+	res[1] = 128 + op
+	res[3] = byte(resultCode)
+	writeUint32(res[4:8], uint32(time.Now().Unix()-s.started.Unix()))
+	writeUint16(res[8:10], internalPort)
+	writeUint16(res[10:12], externalPort)
+	writeUint32(res[12:16], lifetime)
+	if conn != nil {
+		_, err := conn.WriteTo(res, addr)
+		return err
+	}
+	return nil
+}
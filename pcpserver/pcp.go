@@ -0,0 +1,238 @@
+package pcpserver
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// PCP (RFC 6887) v2 handling, layered on top of the same NAT-PMP v0 socket.
+
+const pcpVersion = 2
+
+// Opcodes, RFC 6887 §7.1.
+const (
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+	pcpOpPeer     = 2
+)
+
+// Result codes, RFC 6887 §7.4.
+const (
+	pcpRespSuccess          = 0
+	pcpRespUnsuppVersion    = 1
+	pcpRespNotAuthorized    = 2
+	pcpRespMalformedRequest = 3
+	pcpRespUnsuppOpcode     = 4
+	pcpRespMalformedOption  = 6
+	pcpRespNetworkFailure   = 7
+	pcpRespNoResources      = 8
+	pcpRespUnsuppProtocol   = 9
+	pcpRespAddressMismatch  = 12
+)
+
+func (s *Server) handlePCPRequest(conn net.PacketConn, addr net.Addr, buf []byte) error {
+	if len(buf) < 24 {
+		s.writePCPResponse(conn, addr, pcpRespMalformedRequest, pcpOpAnnounce, 0, nil)
+		return fmt.Errorf("pcp request too short")
+	}
+	if buf[1]&0x80 != 0 {
+		// R bit set means this is a response, clients don't send those to us.
+		s.writePCPResponse(conn, addr, pcpRespMalformedRequest, buf[1]&0x7f, 0, nil)
+		return fmt.Errorf("received pcp response as request")
+	}
+
+	opcode := buf[1] & 0x7f
+	requestLifetime := readUint32(buf[4:8])
+
+	switch opcode {
+	case pcpOpAnnounce:
+		s.writePCPResponse(conn, addr, pcpRespSuccess, opcode, 0, nil)
+		return nil
+	case pcpOpMap, pcpOpPeer:
+		// PEER opcode data is MAP's 36 bytes plus a 16-byte remote peer IP
+		// and 2-byte remote peer port (RFC 6887 §14); we don't track
+		// per-peer filtering state separately from the mapping itself, so
+		// PEER is handled as a MAP request: the remote peer fields are
+		// neither persisted nor echoed back, and the response carries only
+		// the 36 bytes of MAP opcode data.
+		minLen := 24 + 36
+		if opcode == pcpOpPeer {
+			minLen += 18
+		}
+		if len(buf) < minLen {
+			s.writePCPResponse(conn, addr, pcpRespMalformedRequest, opcode, 0, nil)
+			return fmt.Errorf("malformed pcp %s request", opcodeName(opcode))
+		}
+		return s.handlePCPMapRequest(conn, addr, opcode, requestLifetime, buf[24:24+36])
+	default:
+		s.writePCPResponse(conn, addr, pcpRespUnsuppOpcode, opcode, 0, nil)
+		return fmt.Errorf("unsupported pcp opcode %d", opcode)
+	}
+}
+
+func opcodeName(opcode byte) string {
+	if opcode == pcpOpPeer {
+		return "PEER"
+	}
+	return "MAP"
+}
+
+func (s *Server) handlePCPMapRequest(conn net.PacketConn, addr net.Addr, opcode byte, requestLifetime uint32, opData []byte) error {
+	nonce := append([]byte(nil), opData[0:12]...)
+	protoByte := opData[12]
+	internalPort := readUint16(opData[16:18])
+
+	// PCP carries the IANA protocol number here (RFC 6887 §11.1), not the
+	// NAT-PMP opcode protocolName decodes.
+	var protocol string
+	ok := true
+	switch protoByte {
+	case 6:
+		protocol = "tcp"
+	case 17:
+		protocol = "udp"
+	default:
+		ok = false
+	}
+	if !ok {
+		s.writePCPMapResponse(conn, addr, opcode, pcpRespUnsuppProtocol, 0, nonce, protoByte, internalPort, 0)
+		return fmt.Errorf("unsupported pcp protocol %d", protoByte)
+	}
+
+	clientIP := clientAddrFromAddr(addr)
+	lifetime := s.clampLifetime(requestLifetime)
+
+	decision := s.checkACL(clientIP, protocol, internalPort)
+	if decision.LeaseTTL > 0 {
+		lifetime = s.clampLifetime(uint32(decision.LeaseTTL / time.Second))
+	}
+	if !decision.Allowed {
+		s.writePCPMapResponse(conn, addr, opcode, pcpRespNotAuthorized, 0, nonce, protoByte, internalPort, 0)
+		return fmt.Errorf("pcp mapping request denied by ACL")
+	}
+
+	if requestLifetime == 0 {
+		lease, err := s.store.GetLeaseByIpAndPort(clientIP, internalPort, protocol)
+		if err != nil {
+			return fmt.Errorf("error getting existing lease %v", err)
+		}
+		if lease != nil {
+			if len(lease.Nonce) > 0 && !bytesEqual(lease.Nonce, nonce) {
+				s.writePCPMapResponse(conn, addr, opcode, pcpRespAddressMismatch, 0, nonce, protoByte, internalPort, 0)
+				return fmt.Errorf("pcp nonce mismatch on delete")
+			}
+			if err := s.store.DeleteLease(lease.ID); err != nil {
+				return fmt.Errorf("failed to delete lease %v", err)
+			}
+			s.notify(*lease)
+		}
+		s.writePCPMapResponse(conn, addr, opcode, pcpRespSuccess, 0, nonce, protoByte, internalPort, 0)
+		return nil
+	}
+
+	lease, err := s.store.GetLeaseByIpAndPort(clientIP, internalPort, protocol)
+	if err != nil {
+		return fmt.Errorf("error getting existing lease %v", err)
+	}
+	if lease != nil && len(lease.Nonce) > 0 && !bytesEqual(lease.Nonce, nonce) {
+		s.writePCPMapResponse(conn, addr, opcode, pcpRespAddressMismatch, 0, nonce, protoByte, internalPort, 0)
+		return fmt.Errorf("pcp nonce mismatch for existing lease")
+	}
+
+	if lease == nil {
+		if atCap, err := s.atClientLeaseCap(clientIP, decision); err != nil {
+			return fmt.Errorf("error counting active leases %v", err)
+		} else if atCap {
+			s.writePCPMapResponse(conn, addr, opcode, pcpRespNoResources, 0, nonce, protoByte, internalPort, 0)
+			return fmt.Errorf("client at its ACL rule's max leases")
+		}
+
+		externalPort, err := s.store.AllocateExternal(clientIP, protocol, internalPort)
+		if err != nil {
+			s.writePCPMapResponse(conn, addr, opcode, pcpRespNoResources, 0, nonce, protoByte, internalPort, 0)
+			return err
+		}
+		lease = &Lease{
+			ClientIP:     clientIP,
+			ClientPort:   internalPort,
+			Protocol:     protocol,
+			ExternalPort: externalPort,
+		}
+	}
+	lease.LastSeen = time.Now()
+	lease.Nonce = nonce
+	lease.Lifetime = time.Duration(lifetime) * time.Second
+	lease.Expires = lease.LastSeen.Add(lease.Lifetime)
+
+	if err := s.store.UpsertLease(lease); err != nil {
+		return fmt.Errorf("failed to upsert new lease %v", err)
+	}
+	s.notify(*lease)
+	s.triggerReap()
+
+	s.writePCPMapResponse(conn, addr, opcode, pcpRespSuccess, lifetime, nonce, protoByte, internalPort, lease.ExternalPort)
+	return nil
+}
+
+func (s *Server) writePCPMapResponse(conn net.PacketConn, addr net.Addr, opcode byte, resultCode uint8, lifetime uint32, nonce []byte, protoByte byte, internalPort, externalPort uint16) {
+	data := make([]byte, 36)
+	copy(data[0:12], nonce)
+	data[12] = protoByte
+	writeUint16(data[16:18], internalPort)
+	writeUint16(data[18:20], externalPort)
+	v6 := s.externalIPFor(conn).As16()
+	copy(data[20:36], v6[:])
+	s.writePCPResponse(conn, addr, resultCode, opcode, lifetime, data)
+}
+
+// externalIPFor returns the external address to report on the socket a
+// request came in on: NAT-PMP itself is IPv4-only, but PCP MAP requests can
+// arrive on either socket and must be answered with the matching family.
+func (s *Server) externalIPFor(conn net.PacketConn) netip.Addr {
+	if conn == s.conn6 {
+		return s.cfg.ExternalIP6
+	}
+	return s.cfg.ExternalIP
+}
+
+func (s *Server) writePCPResponse(conn net.PacketConn, addr net.Addr, resultCode uint8, opcode byte, lifetime uint32, opData []byte) {
+	res := make([]byte, 24+len(opData))
+	res[0] = pcpVersion
+	res[1] = 0x80 | opcode
+	res[3] = resultCode
+	writeUint32(res[4:8], lifetime)
+	writeUint32(res[8:12], uint32(time.Now().Unix()-s.started.Unix()))
+	copy(res[24:], opData)
+	if conn != nil {
+		conn.WriteTo(res, addr)
+	}
+}
+
+// sendAnnounce multicasts an unsolicited ANNOUNCE response (opcode 0, R=1)
+// to the PCP all-nodes groups (224.0.0.1 for v4, ff02::1 for v6, RFC 6887
+// §7.1) so clients know to re-request their mappings, both on startup and
+// whenever an external address changes.
+func (s *Server) sendAnnounce() {
+	if s.conn != nil {
+		dst := &net.UDPAddr{IP: net.IPv4(224, 0, 0, 1), Port: 5350}
+		s.writePCPResponse(s.conn, dst, pcpRespSuccess, pcpOpAnnounce, 0, nil)
+	}
+	if s.conn6 != nil {
+		dst := &net.UDPAddr{IP: net.ParseIP("ff02::1"), Port: 5350}
+		s.writePCPResponse(s.conn6, dst, pcpRespSuccess, pcpOpAnnounce, 0, nil)
+	}
+}
+
+func bytesEqual(a, b []byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,341 @@
+// Package pcpserver is a standards-compliant PCP (RFC 6887) / NAT-PMP (RFC
+// 6886) UDP frontend, kept as its own package apart from dynport-server's
+// main package, so that off-the-shelf clients (miniupnpc,
+// libnatpmp, BitTorrent clients, Tailscale's portmapper, etc.) can request
+// port mappings without a custom client. It depends only on the small Store
+// interface below, so the main package can plug in its badgerhold-backed
+// DataStore (and raft-proposal path) without this package importing it back.
+package pcpserver
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Default bounds for the granted lifetime, used whenever New is given zero
+// for either, per RFC 6886/6887's commonly cited 120s..24h range.
+const (
+	DefaultMinLifetime = 120
+	DefaultMaxLifetime = 24 * 60 * 60
+)
+
+// reapInterval is how often the background reaper checks for expired leases,
+// independent of the immediate check triggered right after a short-lived
+// mapping is granted.
+const reapInterval = 30 * time.Second
+
+// Lease is this package's view of a port mapping, independent of the
+// PortMappingLease persisted by the main package's DataStore; Store
+// implementations are expected to convert between the two at the boundary.
+type Lease struct {
+	ID           string
+	Created      time.Time
+	LastSeen     time.Time
+	ClientIP     netip.Addr
+	ClientPort   uint16
+	Protocol     string // "tcp" or "udp"
+	ExternalPort uint16
+	Lifetime     time.Duration
+	Expires      time.Time
+	Nonce        []byte // 96-bit PCP mapping nonce, used to authenticate renew/delete
+}
+
+// Store is the lease persistence this server needs, satisfied by an adapter
+// around the main package's DataStore (and, if raft replication is enabled,
+// its ProposeUpsert/ProposeDelete path instead of a direct write).
+type Store interface {
+	GetLeaseByIpAndPort(ip netip.Addr, port uint16, protocol string) (*Lease, error)
+	UpsertLease(lease *Lease) error
+	DeleteLease(id string) error
+	// AllocateExternal picks a free external port for a new mapping from
+	// (clientIP, protocol, internalPort), applying whatever NAT mapping
+	// policy and port-preservation rules the underlying store is configured
+	// with.
+	AllocateExternal(clientIP netip.Addr, protocol string, internalPort uint16) (uint16, error)
+	GetExpiredLeases() ([]*Lease, error)
+	// CountActiveLeases reports how many non-expired leases clientIP
+	// currently holds, for enforcing ACLDecision.MaxLeasesPerClient.
+	CountActiveLeases(clientIP netip.Addr) (int, error)
+}
+
+// ACLDecision is the result of evaluating a mapping request against the
+// operator's ACL: whether it's allowed at all, and the overrides that apply
+// once it is.
+type ACLDecision struct {
+	Allowed bool
+	// LeaseTTL overrides the requested/default lifetime when non-zero.
+	LeaseTTL time.Duration
+	// MaxLeasesPerClient caps how many concurrent leases clientIP may hold
+	// under the rule that decided Allowed; zero means no cap.
+	MaxLeasesPerClient uint32
+}
+
+// ACLChecker evaluates a mapping request against the configured ACL. It's a
+// plain func rather than this package depending on the main package's
+// ACLPolicy type, so the main package can plug its compiled policy in
+// without an import cycle. A nil ACLChecker allows everything; the main
+// package's ACLPolicy.Evaluate instead falls back to its configured
+// allowDefault when no rule matches.
+type ACLChecker func(clientIP netip.Addr, protocol string, port uint16) ACLDecision
+
+type Config struct {
+	ListenAddr  string
+	ExternalIP  netip.Addr
+	ExternalIP6 netip.Addr
+	MinLifetime uint32 // seconds, defaults to DefaultMinLifetime if zero
+	MaxLifetime uint32 // seconds, defaults to DefaultMaxLifetime if zero
+	// ACL is consulted before every new mapping is granted; see ACLChecker.
+	ACL ACLChecker
+}
+
+type Server struct {
+	cfg   Config
+	store Store
+	l     *zap.SugaredLogger
+
+	conn  net.PacketConn
+	conn6 net.PacketConn
+
+	started   time.Time
+	listeners []func(Lease)
+	reapCh    chan bool
+}
+
+func New(l *zap.Logger, store Store, cfg Config) *Server {
+	if cfg.MinLifetime == 0 {
+		cfg.MinLifetime = DefaultMinLifetime
+	}
+	if cfg.MaxLifetime == 0 {
+		cfg.MaxLifetime = DefaultMaxLifetime
+	}
+	return &Server{
+		cfg:    cfg,
+		store:  store,
+		l:      l.Sugar(),
+		reapCh: make(chan bool, 1),
+	}
+}
+
+func (s *Server) RegisterListener(fn func(Lease)) {
+	s.listeners = append(s.listeners, fn)
+}
+
+// SetACL swaps in a newly compiled ACLChecker, for a caller that reloads its
+// ACL config (e.g. on SIGHUP) without restarting the listeners.
+func (s *Server) SetACL(acl ACLChecker) {
+	s.cfg.ACL = acl
+}
+
+// checkACL evaluates clientIP/protocol/port against the configured ACL,
+// allowing everything when none is set.
+func (s *Server) checkACL(clientIP netip.Addr, protocol string, port uint16) ACLDecision {
+	if s.cfg.ACL == nil {
+		return ACLDecision{Allowed: true}
+	}
+	return s.cfg.ACL(clientIP, protocol, port)
+}
+
+// atClientLeaseCap reports whether clientIP already holds decision's
+// MaxLeasesPerClient (or more) active leases, so a brand-new mapping can be
+// refused before AllocateExternal hands out a port for it.
+func (s *Server) atClientLeaseCap(clientIP netip.Addr, decision ACLDecision) (bool, error) {
+	if decision.MaxLeasesPerClient == 0 {
+		return false, nil
+	}
+	count, err := s.store.CountActiveLeases(clientIP)
+	if err != nil {
+		return false, err
+	}
+	return uint32(count) >= decision.MaxLeasesPerClient, nil
+}
+
+func (s *Server) notify(lease Lease) {
+	for _, fn := range s.listeners {
+		go fn(lease)
+	}
+}
+
+// clampLifetime bounds a requested lifetime into [MinLifetime, MaxLifetime],
+// leaving 0 (explicit delete) untouched.
+func (s *Server) clampLifetime(requested uint32) uint32 {
+	if requested == 0 {
+		return 0
+	}
+	if requested < s.cfg.MinLifetime {
+		return s.cfg.MinLifetime
+	}
+	if requested > s.cfg.MaxLifetime {
+		return s.cfg.MaxLifetime
+	}
+	return requested
+}
+
+func (s *Server) Start() error {
+	s.started = time.Now()
+	var err error
+	s.conn, err = net.ListenPacket("udp4", s.cfg.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for udp4 on `%s`: %v", s.cfg.ListenAddr, err)
+	}
+
+	if s.cfg.ExternalIP6.IsValid() {
+		_, port, err := net.SplitHostPort(s.cfg.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("failed to determine port from listenAddr `%s`: %v", s.cfg.ListenAddr, err)
+		}
+		s.conn6, err = net.ListenPacket("udp6", net.JoinHostPort("::", port))
+		if err != nil {
+			return fmt.Errorf("failed to listen for udp6 on port `%s`: %v", port, err)
+		}
+	}
+
+	s.sendAnnounce()
+
+	go s.reapExpiredLeases()
+
+	var wg sync.WaitGroup
+	for _, conn := range []net.PacketConn{s.conn, s.conn6} {
+		if conn == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(conn net.PacketConn) {
+			defer wg.Done()
+			for {
+				buf := make([]byte, 1500)
+				n, addr, err := conn.ReadFrom(buf)
+				if n > 0 {
+					if err := s.handleRequest(conn, addr, buf[0:n]); err != nil {
+						s.l.With(zap.Error(err)).Errorf("failed to handle request from %s", addr)
+					}
+					continue
+				} else if err != nil {
+					s.l.With(zap.Error(err)).Errorf("failed to read")
+					return
+				}
+			}
+		}(conn)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (s *Server) Stop() error {
+	var err error
+	if s.conn != nil {
+		err = s.conn.Close()
+		s.conn = nil
+	}
+	if s.conn6 != nil {
+		if err6 := s.conn6.Close(); err6 != nil {
+			err = err6
+		}
+		s.conn6 = nil
+	}
+	return err
+}
+
+// SetExternalIP updates the IPv4 address reported to clients and, per RFC
+// 6887 §14.1, announces the change to every listener on the PCP multicast
+// group.
+func (s *Server) SetExternalIP(ip netip.Addr) {
+	s.cfg.ExternalIP = ip
+	s.sendAnnounce()
+}
+
+// SetExternalIP6 is the IPv6 counterpart of SetExternalIP.
+func (s *Server) SetExternalIP6(ip netip.Addr) {
+	s.cfg.ExternalIP6 = ip
+	s.sendAnnounce()
+}
+
+func (s *Server) handleRequest(conn net.PacketConn, addr net.Addr, buf []byte) error {
+	switch {
+	case len(buf) >= 1 && buf[0] == 0:
+		return s.handleNATPMPRequest(conn, addr, buf)
+	case len(buf) >= 1 && buf[0] == pcpVersion:
+		return s.handlePCPRequest(conn, addr, buf)
+	default:
+		s.writePCPResponse(conn, addr, pcpRespUnsuppVersion, pcpOpAnnounce, 0, nil)
+		return fmt.Errorf("unsupported version")
+	}
+}
+
+// triggerReap asks the background reaper to run an expiry check now,
+// non-blocking since a check is already pending if the channel is full.
+func (s *Server) triggerReap() {
+	select {
+	case s.reapCh <- true:
+	default:
+	}
+}
+
+func (s *Server) reapExpiredLeases() {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.reapOnce()
+		case <-s.reapCh:
+			s.reapOnce()
+		}
+	}
+}
+
+func (s *Server) reapOnce() {
+	expired, err := s.store.GetExpiredLeases()
+	if err != nil {
+		s.l.With(zap.Error(err)).Warn("failed to list expired leases")
+		return
+	}
+	for _, lease := range expired {
+		if err := s.store.DeleteLease(lease.ID); err != nil {
+			s.l.With(zap.Error(err)).Warnf("failed to reap expired lease %s", lease.ID)
+			continue
+		}
+		s.l.Infof("reaped expired lease %s for %s internalPort %d", lease.ID, lease.ClientIP, lease.ClientPort)
+	}
+}
+
+func randomPort(start, end uint16) uint16 {
+	size := end - start + 1
+	return uint16(rand.Intn(int(size))) + start
+}
+
+func clientAddrFromAddr(addr net.Addr) netip.Addr {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.IP
+	case *net.TCPAddr:
+		ip = addr.IP
+	}
+	a, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return netip.Addr{}
+	}
+	return a.Unmap()
+}
+
+func protocolName(opcode byte) (string, bool) {
+	switch opcode {
+	case 1:
+		return "udp", true
+	case 2:
+		return "tcp", true
+	}
+	return "", false
+}
+
+func writeUint16(buf []byte, v uint16) { binary.BigEndian.PutUint16(buf, v) }
+func writeUint32(buf []byte, v uint32) { binary.BigEndian.PutUint32(buf, v) }
+func readUint16(buf []byte) uint16     { return binary.BigEndian.Uint16(buf) }
+func readUint32(buf []byte) uint32     { return binary.BigEndian.Uint32(buf) }
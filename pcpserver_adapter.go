@@ -0,0 +1,149 @@
+package main
+
+import (
+	"net/netip"
+	"time"
+
+	"dynport-server/pcpserver"
+)
+
+// pcpServerStore adapts DataStore (and, once raft replication has taken over
+// writes, RaftReplication's proposal path instead of a direct upsert/delete)
+// to the pcpserver.Store interface, converting between PortMappingLease and
+// pcpserver.Lease at the boundary so that package doesn't need to import
+// this one back.
+type pcpServerStore struct {
+	store     *DataStore
+	raft      *RaftReplication
+	natPolicy NATPolicy
+}
+
+func protocolFromName(name string) PROTOCOL {
+	if name == "tcp" {
+		return TCP
+	}
+	return UDP
+}
+
+func portMappingLeaseToPCPLease(lease *PortMappingLease) *pcpserver.Lease {
+	return &pcpserver.Lease{
+		ID:           lease.Id,
+		Created:      lease.Created,
+		LastSeen:     lease.LastSeen,
+		ClientIP:     lease.ClientIP,
+		ClientPort:   lease.ClientPort,
+		Protocol:     lease.Protocol.String(),
+		ExternalPort: lease.ExternalPort,
+		Lifetime:     lease.Lifetime,
+		Expires:      lease.Expires,
+		Nonce:        lease.Nonce,
+	}
+}
+
+func pcpLeaseToPortMappingLease(lease pcpserver.Lease) *PortMappingLease {
+	protocol := protocolFromName(lease.Protocol)
+	id := lease.ID
+	if id == "" {
+		id = leaseHash(protocol, lease.ClientIP, lease.ClientPort)
+	}
+	created := lease.Created
+	if created.IsZero() {
+		created = time.Now()
+	}
+	return &PortMappingLease{
+		Id:            id,
+		Created:       created,
+		LastSeen:      lease.LastSeen,
+		ClientIP:      lease.ClientIP,
+		ClientPort:    lease.ClientPort,
+		Protocol:      protocol,
+		AddressFamily: addressFamilyOf(lease.ClientIP),
+		ExternalPort:  lease.ExternalPort,
+		Lifetime:      lease.Lifetime,
+		Expires:       lease.Expires,
+		Nonce:         lease.Nonce,
+	}
+}
+
+// aclCheckerFor adapts an aclPolicyHolder (kept up to date by WatchSIGHUP)
+// into the pcpserver.ACLChecker func pcpserver.Server consults on every new
+// mapping, translating the compiled ACLPolicy.Evaluate's winning rule into
+// the subset of per-rule overrides pcpserver understands.
+func aclCheckerFor(acl *aclPolicyHolder) pcpserver.ACLChecker {
+	return func(clientIP netip.Addr, protocol string, port uint16) pcpserver.ACLDecision {
+		allowed, rule := acl.get().Evaluate(clientIP, protocolFromName(protocol), port)
+		decision := pcpserver.ACLDecision{Allowed: allowed}
+		if rule != nil {
+			decision.LeaseTTL = rule.leaseTTL
+			decision.MaxLeasesPerClient = rule.maxLeasesPerClient
+		}
+		return decision
+	}
+}
+
+func (a *pcpServerStore) GetLeaseByIpAndPort(ip netip.Addr, port uint16, protocol string) (*pcpserver.Lease, error) {
+	lease, err := a.store.GetLeaseByIpAndPort(ip, port, protocolFromName(protocol))
+	if err != nil || lease == nil {
+		return nil, err
+	}
+	return portMappingLeaseToPCPLease(lease), nil
+}
+
+func (a *pcpServerStore) UpsertLease(lease *pcpserver.Lease) error {
+	pml := pcpLeaseToPortMappingLease(*lease)
+	var err error
+	if a.raft != nil {
+		err = a.raft.ProposeUpsert(pml)
+	} else {
+		err = a.store.UpsertLease(pml)
+	}
+	if err != nil {
+		return err
+	}
+	lease.ID = pml.Id
+	return nil
+}
+
+func (a *pcpServerStore) DeleteLease(id string) error {
+	if a.raft != nil {
+		return a.raft.ProposeDelete(id)
+	}
+	return a.store.DeleteLease(id)
+}
+
+func (a *pcpServerStore) AllocateExternal(clientIP netip.Addr, protocol string, internalPort uint16) (uint16, error) {
+	lease := &PortMappingLease{
+		ClientIP:   clientIP,
+		ClientPort: internalPort,
+		Protocol:   protocolFromName(protocol),
+	}
+	return a.store.AllocateExternal(lease, a.natPolicy, false)
+}
+
+func (a *pcpServerStore) CountActiveLeases(clientIP netip.Addr) (int, error) {
+	leases, err := a.store.GetActiveLeasesByClientIP(clientIP)
+	if err != nil {
+		return 0, err
+	}
+	// Leases past Expires that the reaper hasn't removed yet don't count.
+	count := 0
+	now := time.Now()
+	for _, lease := range leases {
+		if lease.Expires.IsZero() || lease.Expires.After(now) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (a *pcpServerStore) GetExpiredLeases() ([]*pcpserver.Lease, error) {
+	leases, err := a.store.GetExpiredLeases()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*pcpserver.Lease, 0, len(leases))
+	for _, lease := range leases {
+		result = append(result, portMappingLeaseToPCPLease(lease))
+	}
+	return result, nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/timshannon/badgerhold"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// parsePortRange parses config.PortRange's "start-end" format (already
+// validated by the "range" validator in cmd.go) into its bounds.
+func parsePortRange(s string) (uint16, uint16, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	start, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %v", s, err)
+	}
+	end, err := strconv.ParseUint(parts[1], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %v", s, err)
+	}
+	return uint16(start), uint16(end), nil
+}
+
+// NATPolicy selects which classic NAT behavior (RFC 3489's Full/Restricted
+// Cone and Symmetric terminology, still the names operators reach for even
+// though RFC 4787 reclassifies them as separate mapping/filtering
+// behaviors) this listener's external port allocator emulates.
+//
+// The mapping side - whether an internal (clientIP, clientPort, protocol)
+// tuple always gets the same external port - is what AllocateExternal
+// implements below. The filtering side - which remote hosts/ports may send
+// to that external port - is enforced by the ACL/iptables layers, not here.
+type NATPolicy uint8
+
+const (
+	// EndpointIndependentNAT is Full Cone: one external port per internal
+	// tuple, reachable from any remote host/port. This is the mapping
+	// behavior DataStore has always had.
+	EndpointIndependentNAT NATPolicy = iota
+	// AddressRestrictedNAT uses the same mapping behavior as
+	// EndpointIndependentNAT; its filtering restriction by remote address
+	// is the ACL/iptables layers' responsibility.
+	AddressRestrictedNAT
+	// PortRestrictedNAT further restricts filtering by remote port, again
+	// outside DataStore's scope.
+	PortRestrictedNAT
+	// SymmetricNAT would allocate a distinct external port per remote
+	// destination. PortMappingLease has no notion of "remote destination"
+	// today (NAT-PMP/PCP mappings are keyed by the internal tuple only), so
+	// this policy is accepted but currently allocates the same way
+	// EndpointIndependentNAT does; it only changes the deterministic seed
+	// AllocateExternal starts its scan from.
+	SymmetricNAT
+)
+
+func (p NATPolicy) String() string {
+	switch p {
+	case AddressRestrictedNAT:
+		return "address-restricted"
+	case PortRestrictedNAT:
+		return "port-restricted"
+	case SymmetricNAT:
+		return "symmetric"
+	default:
+		return "endpoint-independent"
+	}
+}
+
+// ParseNATPolicy parses the --nat-policy flag/config value.
+func ParseNATPolicy(s string) (NATPolicy, error) {
+	switch s {
+	case "", "endpoint-independent":
+		return EndpointIndependentNAT, nil
+	case "address-restricted":
+		return AddressRestrictedNAT, nil
+	case "port-restricted":
+		return PortRestrictedNAT, nil
+	case "symmetric":
+		return SymmetricNAT, nil
+	}
+	return 0, fmt.Errorf("unknown nat policy %q", s)
+}
+
+// portBitmap persists which ports in a family's configured range are
+// currently leased, one bit per port, so AllocateExternal can find a free
+// port in O(1) amortized (a handful of word scans) instead of scanning the
+// whole lease table the way IsExternalPortInUse did.
+type portBitmap struct {
+	Bits []byte
+}
+
+func portBitmapKey(family AddressFamily) string {
+	return fmt.Sprintf("portbitmap:%s", family)
+}
+
+func (d *DataStore) loadPortBitmap(family AddressFamily) (*portBitmap, error) {
+	bm := &portBitmap{}
+	err := d.store.Get(portBitmapKey(family), bm)
+	if err == badgerhold.ErrNotFound {
+		return &portBitmap{Bits: make([]byte, (d.portRangeSize()+7)/8)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bm, nil
+}
+
+func (d *DataStore) savePortBitmap(family AddressFamily, bm *portBitmap) error {
+	key := portBitmapKey(family)
+	if err := d.store.Update(key, bm); err == badgerhold.ErrNotFound {
+		return d.store.Insert(key, bm)
+	} else {
+		return err
+	}
+}
+
+func bitSet(bits []byte, idx int) bool {
+	byteIdx, bit := idx/8, uint(idx%8)
+	if bits[byteIdx]&(1<<bit) != 0 {
+		return false
+	}
+	bits[byteIdx] |= 1 << bit
+	return true
+}
+
+func bitIsSet(bits []byte, idx int) bool {
+	byteIdx, bit := idx/8, uint(idx%8)
+	return bits[byteIdx]&(1<<bit) != 0
+}
+
+func bitClear(bits []byte, idx int) {
+	byteIdx, bit := idx/8, uint(idx%8)
+	bits[byteIdx] &^= 1 << bit
+}
+
+func (d *DataStore) portRangeSize() int {
+	return int(d.portRangeEnd-d.portRangeStart) + 1
+}
+
+func (d *DataStore) inPortRange(port uint16) bool {
+	return port >= d.portRangeStart && port <= d.portRangeEnd
+}
+
+// AllocateExternal picks a free external port for lease, scoped to its
+// address family, and records the choice in that family's port bitmap.
+// Release it again with ReleaseExternal once the lease is gone (DeleteLease
+// does this automatically for ordinary leases).
+//
+// Order of preference:
+//  1. the client's own internal port, if it's free and in range (RFC 4787
+//     REQ-4 port preservation - lets e.g. a SIP client keep 5060 end to end);
+//  2. if paired is set (the RTP/RTCP convention of an even port plus its
+//     odd successor), the first free even/odd pair in range;
+//  3. otherwise a deterministic scan of the range starting at a hash of
+//     (policy, protocol, clientIP, clientPort), so the same internal tuple
+//     always probes the range in the same order and symmetric-vs-cone
+//     policies land on different starting ports for the same tuple.
+func (d *DataStore) AllocateExternal(lease *PortMappingLease, policy NATPolicy, paired bool) (uint16, error) {
+	d.portAllocMu.Lock()
+	defer d.portAllocMu.Unlock()
+
+	family := addressFamilyOf(lease.ClientIP)
+	bm, err := d.loadPortBitmap(family)
+	if err != nil {
+		return 0, err
+	}
+
+	if paired {
+		port, err := d.allocatePaired(bm)
+		if err != nil {
+			return 0, err
+		}
+		if err := d.savePortBitmap(family, bm); err != nil {
+			return 0, err
+		}
+		return port, nil
+	}
+
+	if d.inPortRange(lease.ClientPort) && bitSet(bm.Bits, int(lease.ClientPort-d.portRangeStart)) {
+		if err := d.savePortBitmap(family, bm); err != nil {
+			return 0, err
+		}
+		return lease.ClientPort, nil
+	}
+
+	rangeSize := d.portRangeSize()
+	start := int(deterministicPortSeed(policy, lease.Protocol, lease.ClientIP, lease.ClientPort) % uint32(rangeSize))
+	for i := 0; i < rangeSize; i++ {
+		port := d.portRangeStart + uint16((start+i)%rangeSize)
+		if bitSet(bm.Bits, int(port-d.portRangeStart)) {
+			if err := d.savePortBitmap(family, bm); err != nil {
+				return 0, err
+			}
+			return port, nil
+		}
+	}
+	return 0, fmt.Errorf("no port is free in range %d-%d", d.portRangeStart, d.portRangeEnd)
+}
+
+func (d *DataStore) allocatePaired(bm *portBitmap) (uint16, error) {
+	rangeSize := d.portRangeSize()
+	for i := 0; i < rangeSize-1; i++ {
+		port := d.portRangeStart + uint16(i)
+		if port%2 != 0 {
+			continue
+		}
+		idx := int(port - d.portRangeStart)
+		if bitIsSet(bm.Bits, idx) || bitIsSet(bm.Bits, idx+1) {
+			continue
+		}
+		bitSet(bm.Bits, idx)
+		bitSet(bm.Bits, idx+1)
+		return port, nil
+	}
+	return 0, fmt.Errorf("no paired port available in range %d-%d", d.portRangeStart, d.portRangeEnd)
+}
+
+// ReleaseExternal frees port back to family's port bitmap; paired must
+// match however the port was allocated, so the odd successor reserved
+// alongside an even AllocateExternal(..., paired=true) is freed too.
+func (d *DataStore) ReleaseExternal(family AddressFamily, port uint16, paired bool) error {
+	d.portAllocMu.Lock()
+	defer d.portAllocMu.Unlock()
+	if !d.inPortRange(port) {
+		return nil
+	}
+	bm, err := d.loadPortBitmap(family)
+	if err != nil {
+		return err
+	}
+	idx := int(port - d.portRangeStart)
+	bitClear(bm.Bits, idx)
+	if paired && port%2 == 0 && port < d.portRangeEnd {
+		bitClear(bm.Bits, idx+1)
+	}
+	return d.savePortBitmap(family, bm)
+}
+
+// markExternalAllocated sets port's bit in family's port bitmap without
+// allocating a new one. AllocateExternal already does this for the node that
+// picked the port; this exists for leaseFSM.Apply, which applies an upsert
+// already carrying an ExternalPort chosen by whichever node was raft leader
+// at the time, on every other node in the cluster. Without it, a follower's
+// bitmap never learns about ports leader nodes hand out, and would hand the
+// same port out again itself after an election.
+func (d *DataStore) markExternalAllocated(family AddressFamily, port uint16) error {
+	d.portAllocMu.Lock()
+	defer d.portAllocMu.Unlock()
+	if !d.inPortRange(port) {
+		return nil
+	}
+	bm, err := d.loadPortBitmap(family)
+	if err != nil {
+		return err
+	}
+	bitSet(bm.Bits, int(port-d.portRangeStart))
+	return d.savePortBitmap(family, bm)
+}
+
+// rebuildPortBitmaps resets both families' port bitmaps from the current
+// lease table, making them self-healing: if the process crashed between
+// committing a lease and persisting its bitmap bit (or an older version
+// never maintained a bitmap at all), the next open derives the correct
+// state straight from the leases rather than trusting stale bitmap bytes.
+func (d *DataStore) rebuildPortBitmaps() error {
+	leases, err := d.GetLeases()
+	if err != nil {
+		return err
+	}
+	bitmaps := map[AddressFamily]*portBitmap{
+		IPv4: {Bits: make([]byte, (d.portRangeSize()+7)/8)},
+		IPv6: {Bits: make([]byte, (d.portRangeSize()+7)/8)},
+	}
+	for _, lease := range leases {
+		if !d.inPortRange(lease.ExternalPort) {
+			continue
+		}
+		bitSet(bitmaps[lease.AddressFamily].Bits, int(lease.ExternalPort-d.portRangeStart))
+	}
+	for family, bm := range bitmaps {
+		if err := d.savePortBitmap(family, bm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deterministicPortSeed(policy NATPolicy, protocol PROTOCOL, clientIP netip.Addr, clientPort uint16) uint32 {
+	data := make([]byte, 0, 1+1+16+2)
+	data = append(data, byte(policy))
+	data = append(data, byte(protocol))
+	ipBytes := clientIP.As16()
+	data = append(data, ipBytes[:]...)
+	data = binary.BigEndian.AppendUint16(data, clientPort)
+	sum := sha256.Sum256(data)
+	return binary.BigEndian.Uint32(sum[:4])
+}
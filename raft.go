@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	hraft "github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"go.uber.org/zap"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrNotLeader is returned when a write is proposed against a node that
+// isn't currently the raft leader; callers should redirect to Leader().
+var ErrNotLeader = fmt.Errorf("not the raft leader")
+
+type raftOp string
+
+const (
+	raftOpUpsert raftOp = "upsert"
+	raftOpDelete raftOp = "delete"
+)
+
+type raftCommand struct {
+	Op    raftOp
+	Lease *PortMappingLease `json:",omitempty"`
+	Id    string            `json:",omitempty"`
+}
+
+// RaftReplication consensus-replicates the lease table across peers, using
+// hashicorp/raft, so that two nodes can never hand out the same external
+// port during a partition. Only the leader accepts ProposeUpsert/ProposeDelete.
+type RaftReplication struct {
+	l    *zap.SugaredLogger
+	raft *hraft.Raft
+}
+
+// NewRaftReplication starts (or joins) a raft cluster backed by a BoltDB log
+// store under dataDir, using bindAddr (RaftListenAddr in start()) as both the
+// node ID and the transport bind address. onApply is invoked synchronously after every
+// applied log entry (lease create/update/delete), so callers can trigger
+// iptables/eBPF reconciliation immediately instead of waiting for the next tick.
+func NewRaftReplication(l *zap.Logger, store *DataStore, dataDir, bindAddr string, peers []string, secret string, onApply func()) (*RaftReplication, error) {
+	raftDir := filepath.Join(dataDir, "raft")
+	if err := os.MkdirAll(raftDir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create raft dir: %v", err)
+	}
+
+	conf := hraft.DefaultConfig()
+	conf.LocalID = hraft.ServerID(bindAddr)
+	conf.LogOutput = os.Stderr
+
+	fsm := &leaseFSM{store: store, onApply: onApply}
+
+	snapshots, err := hraft.NewFileSnapshotStore(raftDir, 2, os.Stderr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create raft snapshot store: %v", err)
+	}
+
+	logStore, err := raftboltdb.NewBoltStore(filepath.Join(raftDir, "raft-log.bolt"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create raft log store: %v", err)
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", bindAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve raft bind addr %s: %v", bindAddr, err)
+	}
+	listener, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for raft transport on %s: %v", bindAddr, err)
+	}
+	transport := hraft.NewNetworkTransport(newHMACStreamLayer(listener, []byte(secret)), 3, 10*time.Second, os.Stderr)
+
+	r, err := hraft.NewRaft(conf, fsm, logStore, logStore, snapshots, transport)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start raft node: %v", err)
+	}
+
+	servers := []hraft.Server{{ID: conf.LocalID, Address: transport.LocalAddr()}}
+	for _, peer := range peers {
+		servers = append(servers, hraft.Server{ID: hraft.ServerID(peer), Address: hraft.ServerAddress(peer)})
+	}
+	hasState, err := hraft.HasExistingState(logStore, logStore, snapshots)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect existing raft state: %v", err)
+	}
+	if !hasState {
+		// Every node bootstraps the same configuration; raft dedupes for us
+		// once one of them wins the race and the others see the committed config.
+		r.BootstrapCluster(hraft.Configuration{Servers: servers})
+	}
+
+	return &RaftReplication{l: l.Sugar(), raft: r}, nil
+}
+
+func (r *RaftReplication) IsLeader() bool {
+	return r.raft.State() == hraft.Leader
+}
+
+func (r *RaftReplication) Leader() string {
+	addr, _ := r.raft.LeaderWithID()
+	return string(addr)
+}
+
+func (r *RaftReplication) apply(cmd raftCommand) error {
+	if !r.IsLeader() {
+		return ErrNotLeader
+	}
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	f := r.raft.Apply(b, 5*time.Second)
+	if err := f.Error(); err != nil {
+		return err
+	}
+	if applyErr, ok := f.Response().(error); ok && applyErr != nil {
+		return applyErr
+	}
+	return nil
+}
+
+func (r *RaftReplication) ProposeUpsert(lease *PortMappingLease) error {
+	return r.apply(raftCommand{Op: raftOpUpsert, Lease: lease})
+}
+
+func (r *RaftReplication) ProposeDelete(id string) error {
+	return r.apply(raftCommand{Op: raftOpDelete, Id: id})
+}
+
+func (r *RaftReplication) AddPeer(id, addr string) error {
+	if !r.IsLeader() {
+		return ErrNotLeader
+	}
+	return r.raft.AddVoter(hraft.ServerID(id), hraft.ServerAddress(addr), 0, 10*time.Second).Error()
+}
+
+func (r *RaftReplication) RemovePeer(id string) error {
+	if !r.IsLeader() {
+		return ErrNotLeader
+	}
+	return r.raft.RemoveServer(hraft.ServerID(id), 0, 10*time.Second).Error()
+}
+
+func (r *RaftReplication) Shutdown() error {
+	return r.raft.Shutdown().Error()
+}
+
+// leaseFSM applies committed raft log entries to the local DataStore and
+// provides a full lease-table snapshot/restore so joining followers catch up.
+type leaseFSM struct {
+	store   *DataStore
+	onApply func()
+}
+
+func (f *leaseFSM) Apply(log *hraft.Log) interface{} {
+	var cmd raftCommand
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		return err
+	}
+
+	var err error
+	switch cmd.Op {
+	case raftOpUpsert:
+		err = f.store.UpsertLease(cmd.Lease)
+		// UpsertLease only persists the lease record; it doesn't touch the
+		// port bitmap AllocateExternal/ReleaseExternal maintain (that's the
+		// allocating node's job, done before this command was even
+		// proposed). Every other node in the cluster only learns about the
+		// lease's ExternalPort here, so it has to mark it in its own bitmap
+		// or it'll think that port is still free after an election.
+		if err == nil && f.store.inPortRange(cmd.Lease.ExternalPort) {
+			err = f.store.markExternalAllocated(cmd.Lease.AddressFamily, cmd.Lease.ExternalPort)
+		}
+	case raftOpDelete:
+		err = f.store.DeleteLease(cmd.Id)
+	default:
+		err = fmt.Errorf("unknown raft command %q", cmd.Op)
+	}
+
+	if f.onApply != nil {
+		f.onApply()
+	}
+	return err
+}
+
+func (f *leaseFSM) Snapshot() (hraft.FSMSnapshot, error) {
+	leases, err := f.store.GetLeases()
+	if err != nil {
+		return nil, err
+	}
+	return &leaseSnapshot{leases: leases}, nil
+}
+
+func (f *leaseFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var leases []*PortMappingLease
+	if err := json.NewDecoder(rc).Decode(&leases); err != nil {
+		return err
+	}
+	for _, lease := range leases {
+		if err := f.store.UpsertLease(lease); err != nil {
+			return err
+		}
+		// Same as Apply's upsert: a restored lease's ExternalPort must be
+		// marked in this node's bitmap too.
+		if f.store.inPortRange(lease.ExternalPort) {
+			if err := f.store.markExternalAllocated(lease.AddressFamily, lease.ExternalPort); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type leaseSnapshot struct {
+	leases []*PortMappingLease
+}
+
+func (s *leaseSnapshot) Persist(sink hraft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.leases); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *leaseSnapshot) Release() {}
+
+// hmacStreamLayer wraps the raw raft TCP transport with HMAC-SHA256 framing
+// keyed on ReplicationSecret, so a node without the secret can't inject or
+// tamper with raft traffic. Frames are authenticated, not encrypted: the
+// payload itself crosses the wire in the clear. This is the same secret
+// already used to guard the replication HTTP endpoints.
+type hmacStreamLayer struct {
+	net.Listener
+	secret []byte
+}
+
+func newHMACStreamLayer(l net.Listener, secret []byte) *hmacStreamLayer {
+	return &hmacStreamLayer{Listener: l, secret: secret}
+}
+
+func (h *hmacStreamLayer) Accept() (net.Conn, error) {
+	conn, err := h.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return newHMACConn(conn, h.secret), nil
+}
+
+func (h *hmacStreamLayer) Dial(address hraft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", string(address), timeout)
+	if err != nil {
+		return nil, err
+	}
+	return newHMACConn(conn, h.secret), nil
+}
+
+type hmacConn struct {
+	net.Conn
+	secret []byte
+	rbuf   bytes.Buffer
+}
+
+func newHMACConn(conn net.Conn, secret []byte) *hmacConn {
+	return &hmacConn{Conn: conn, secret: secret}
+}
+
+// Write frames the payload as [4-byte length][32-byte HMAC-SHA256][payload].
+func (c *hmacConn) Write(p []byte) (int, error) {
+	mac := hmac.New(sha256.New, c.secret)
+	mac.Write(p)
+	sum := mac.Sum(nil)
+
+	var hdr [4]byte
+	binary.BigEndian.PutUint32(hdr[:], uint32(len(p)))
+	if _, err := c.Conn.Write(hdr[:]); err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(sum); err != nil {
+		return 0, err
+	}
+	if _, err := c.Conn.Write(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *hmacConn) Read(p []byte) (int, error) {
+	if c.rbuf.Len() == 0 {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		length := binary.BigEndian.Uint32(hdr[:])
+
+		sum := make([]byte, sha256.Size)
+		if _, err := io.ReadFull(c.Conn, sum); err != nil {
+			return 0, err
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.Conn, payload); err != nil {
+			return 0, err
+		}
+
+		mac := hmac.New(sha256.New, c.secret)
+		mac.Write(payload)
+		if !hmac.Equal(sum, mac.Sum(nil)) {
+			return 0, fmt.Errorf("hmac mismatch on raft transport frame")
+		}
+		c.rbuf.Write(payload)
+	}
+	return c.rbuf.Read(p)
+}
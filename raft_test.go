@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+	"time"
+
+	hraft "github.com/hashicorp/raft"
+	"go.uber.org/zap"
+)
+
+// TestLeaseFSM_ApplyUpsertMarksPortBitmap is a regression test for a
+// follower's port bitmap diverging from the raft-replicated lease table: the
+// node that allocated the external port marks its own bitmap in
+// AllocateExternal, but every other node only ever learns about that port
+// through an applied upsert command, which used to go straight to
+// UpsertLease without touching the bitmap at all.
+func TestLeaseFSM_ApplyUpsertMarksPortBitmap(t *testing.T) {
+	store, err := NewDataStore(zap.NewNop(), t.TempDir(), 10000, 19999, "test-node")
+	if err != nil {
+		t.Fatalf("failed to open datastore: %v", err)
+	}
+	defer store.Close()
+
+	fsm := &leaseFSM{store: store}
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	lease := &PortMappingLease{
+		Id:            leaseHash(TCP, ip, 80),
+		ClientIP:      ip,
+		ClientPort:    80,
+		Protocol:      TCP,
+		ExternalPort:  12345,
+		AddressFamily: IPv4,
+		LastSeen:      time.Now(),
+	}
+	data, err := json.Marshal(raftCommand{Op: raftOpUpsert, Lease: lease})
+	if err != nil {
+		t.Fatalf("failed to marshal raft command: %v", err)
+	}
+
+	if result := fsm.Apply(&hraft.Log{Data: data}); result != nil {
+		t.Fatalf("leaseFSM.Apply: %v", result)
+	}
+
+	bm, err := store.loadPortBitmap(IPv4)
+	if err != nil {
+		t.Fatalf("loadPortBitmap: %v", err)
+	}
+	if !bitIsSet(bm.Bits, int(lease.ExternalPort-store.portRangeStart)) {
+		t.Fatal("expected applying an upsert to mark its ExternalPort in the bitmap, it didn't")
+	}
+
+	// A second node allocating a fresh lease must not be handed the same
+	// port back out, or we've reintroduced the double-allocation this fix
+	// closes.
+	other := &PortMappingLease{
+		Id:         leaseHash(TCP, netip.MustParseAddr("192.0.2.2"), 80),
+		ClientIP:   netip.MustParseAddr("192.0.2.2"),
+		ClientPort: 80,
+		Protocol:   TCP,
+	}
+	port, err := store.AllocateExternal(other, EndpointIndependentNAT, false)
+	if err != nil {
+		t.Fatalf("AllocateExternal: %v", err)
+	}
+	if port == lease.ExternalPort {
+		t.Fatalf("AllocateExternal handed out %d, which is already leased", port)
+	}
+}
@@ -2,16 +2,19 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/go-http-utils/headers"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"runtime/debug"
+	"sort"
 	"strings"
 	"time"
 )
@@ -26,6 +29,13 @@ type Replication struct {
 	peers      []string
 	secret     string
 	listeners  []func()
+
+	// raft is set once a RaftReplication cluster has taken over write
+	// replication, at which point the basic-auth PUT/full-sync gossip below
+	// is retired in favour of the raft log: two replication mechanisms
+	// racing to apply the same lease is exactly the split-brain this was
+	// meant to fix.
+	raft *RaftReplication
 }
 
 func NewReplication(l *zap.Logger, store *DataStore, listenAddr, secret string, peers []string) *Replication {
@@ -48,6 +58,10 @@ func (r *Replication) Start() {
 		r.l.Info("replication is not enabled")
 		return
 	}
+	// Registered unconditionally, and regardless of whether RegisterRaftAdmin
+	// has been called yet: the PUT handler itself checks r.raft at request
+	// time (see setupHandlers), so enabling raft always wins the race with
+	// call order instead of depending on it.
 	r.setupHandlers()
 	go func() {
 		err := r.g.Run(r.listenAddr)
@@ -67,52 +81,178 @@ func (r *Replication) sendUpdate() {
 	}
 }
 
-func (r *Replication) RunFullSync() {
-	if r.listenAddr == "" {
+// leaseDigest is a single root hash over every lease record (including
+// tombstones) keyed by Id, sorted so two replicas with the same lease set
+// compute the same value regardless of insertion order. This is a
+// single-level digest rather than a full Merkle tree: RunAntiEntropy can
+// cheaply tell "this peer has diverged" from a digest mismatch, but not
+// which leases diverged, so a mismatch still costs a full exchange with
+// that one peer rather than just the diverged subtree.
+func leaseDigest(leases []*PortMappingLease) string {
+	sorted := make([]*PortMappingLease, len(leases))
+	copy(sorted, leases)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Id < sorted[j].Id })
+
+	h := sha256.New()
+	for _, lease := range sorted {
+		fmt.Fprintf(h, "%s|%d|%t\n", lease.Id, lease.Clock, lease.Deleted)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// RunAntiEntropy performs one round of SWIM-style push-pull anti-entropy:
+// pick a single random peer, compare lease-set digests, and only exchange
+// full lease lists when they differ. Talking to one random peer per tick
+// instead of every peer (the old RunFullSync behaviour) is what makes this
+// gossip rather than O(N·peers) polling; leases ride a peer long enough for
+// this to still reach everyone eventually, the same tradeoff SWIM makes for
+// membership.
+func (r *Replication) RunAntiEntropy() {
+	if r.listenAddr == "" || r.raft != nil || len(r.peers) == 0 {
 		return
 	}
-	for _, peer := range r.peers {
-		u := fmt.Sprintf("http://%s/leases", peer)
-		req, err := http.NewRequest("GET", u, nil)
-		if err != nil {
-			r.l.With(zap.Error(err), zap.String("url.origin", u)).Warn("failed to create request for getting leases")
-			continue
-		}
-		req.Header.Set(headers.Accept, "application/json")
-		req.SetBasicAuth("repl", r.secret)
+	peer := r.peers[rand.Intn(len(r.peers))]
 
-		response, err := r.client.Do(req)
-		if err != nil {
-			r.l.With(zap.Error(err), zap.String("url.origin", u)).Warn("failed to get leases")
-			continue
-		}
-		defer response.Body.Close()
+	localLeases, err := r.store.GetAllLeases()
+	if err != nil {
+		r.l.With(zap.Error(err)).Warn("failed to list local leases for anti-entropy")
+		return
+	}
+	localDigest := leaseDigest(localLeases)
 
-		if response.StatusCode != 200 {
-			r.l.With(zap.String("url.origin", u)).Warn("unexpected response status code")
-			continue
-		}
-		var leases []PortMappingLease
-		err = json.NewDecoder(response.Body).Decode(&leases)
-		if err != nil {
-			r.l.With(zap.Error(err), zap.String("url.origin", u)).Warn("failed to get leases")
-			continue
-		}
-		for _, lease := range leases {
-			err := r.store.UpsertLease(&lease)
-			if err != nil {
-				r.l.With(zap.Error(err), zap.String("url.origin", u)).Warn("failed to upsert lease")
-				continue
-			}
+	peerDigest, ok := r.getDigest(peer)
+	if !ok {
+		return
+	}
+	if peerDigest == localDigest {
+		r.l.Sugar().Debugf("lease set already in sync with %s", peer)
+		return
+	}
+
+	peerLeases, ok := r.getLeases(peer)
+	if !ok {
+		return
+	}
+	for _, lease := range peerLeases {
+		if err := r.store.Merge(&lease); err != nil {
+			r.l.With(zap.Error(err), zap.String("peer", peer)).Warn("failed to merge lease from peer")
 		}
 	}
+	r.pushLeases(peer, localLeases)
 	r.sendUpdate()
 }
 
+func (r *Replication) getDigest(peer string) (string, bool) {
+	u := fmt.Sprintf("http://%s/digest", peer)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		r.l.With(zap.Error(err), zap.String("url.origin", u)).Warn("failed to create request for getting digest")
+		return "", false
+	}
+	req.Header.Set(headers.Accept, "application/json")
+	req.SetBasicAuth("repl", r.secret)
+
+	response, err := r.client.Do(req)
+	if err != nil {
+		replicationPeerSyncFailuresTotal.WithLabelValues(peer).Inc()
+		r.l.With(zap.Error(err), zap.String("url.origin", u)).Warn("failed to get digest")
+		return "", false
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		replicationPeerSyncFailuresTotal.WithLabelValues(peer).Inc()
+		r.l.With(zap.String("url.origin", u)).Warn("unexpected response status code")
+		return "", false
+	}
+	var body struct {
+		Digest string `json:"digest"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil {
+		replicationPeerSyncFailuresTotal.WithLabelValues(peer).Inc()
+		r.l.With(zap.Error(err), zap.String("url.origin", u)).Warn("failed to decode digest")
+		return "", false
+	}
+	return body.Digest, true
+}
+
+func (r *Replication) getLeases(peer string) ([]PortMappingLease, bool) {
+	u := fmt.Sprintf("http://%s/leases", peer)
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		r.l.With(zap.Error(err), zap.String("url.origin", u)).Warn("failed to create request for getting leases")
+		return nil, false
+	}
+	req.Header.Set(headers.Accept, "application/json")
+	req.SetBasicAuth("repl", r.secret)
+
+	response, err := r.client.Do(req)
+	if err != nil {
+		replicationPeerSyncFailuresTotal.WithLabelValues(peer).Inc()
+		r.l.With(zap.Error(err), zap.String("url.origin", u)).Warn("failed to get leases")
+		return nil, false
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		replicationPeerSyncFailuresTotal.WithLabelValues(peer).Inc()
+		r.l.With(zap.String("url.origin", u)).Warn("unexpected response status code")
+		return nil, false
+	}
+	var leases []PortMappingLease
+	if err := json.NewDecoder(response.Body).Decode(&leases); err != nil {
+		replicationPeerSyncFailuresTotal.WithLabelValues(peer).Inc()
+		r.l.With(zap.Error(err), zap.String("url.origin", u)).Warn("failed to decode leases")
+		return nil, false
+	}
+	return leases, true
+}
+
+// pushLeases is the "push" half of push-pull anti-entropy: PUT every local
+// record to peer, reusing the same endpoint PortMappingLeaseListener
+// already uses to propagate a single update, so peer's Merge handler
+// resolves any conflict the identical way.
+func (r *Replication) pushLeases(peer string, leases []*PortMappingLease) {
+	for _, lease := range leases {
+		r.putLease(peer, lease)
+	}
+}
+
+func (r *Replication) putLease(peer string, lease *PortMappingLease) {
+	jsonBytes, err := json.Marshal(lease)
+	if err != nil {
+		r.l.With(zap.Error(err)).Warn("failed to marshal lease")
+		return
+	}
+
+	u := fmt.Sprintf("http://%s/leases/%s", peer, lease.Id)
+	req, err := http.NewRequest("PUT", u, bytes.NewReader(jsonBytes))
+	if err != nil {
+		r.l.With(zap.Error(err), zap.String("url.origin", u)).Warn("failed to create request for putting lease")
+		return
+	}
+	req.Header.Set(headers.ContentType, "application/json")
+	req.SetBasicAuth("repl", r.secret)
+
+	response, err := r.client.Do(req)
+	if err != nil {
+		replicationPeerSyncFailuresTotal.WithLabelValues(peer).Inc()
+		r.l.With(zap.Error(err), zap.String("url.origin", u)).Warn("failed to put lease")
+		return
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != 200 {
+		replicationPeerSyncFailuresTotal.WithLabelValues(peer).Inc()
+		r.l.With(zap.String("url.origin", u), zap.Int("http.response.status_code", response.StatusCode)).
+			Warn("unexpected response status code")
+	}
+}
+
 func (r *Replication) setupHandlers() {
 	g := r.g
 	g.GET("/leases", func(c *gin.Context) {
-		leases, err := r.store.GetLeases()
+		leases, err := r.store.GetAllLeases()
 		if err != nil {
 			c.Error(err)
 			c.AbortWithStatus(500)
@@ -121,7 +261,25 @@ func (r *Replication) setupHandlers() {
 
 		c.JSON(200, leases)
 	})
+	g.GET("/digest", func(c *gin.Context) {
+		leases, err := r.store.GetAllLeases()
+		if err != nil {
+			c.Error(err)
+			c.AbortWithStatus(500)
+			return
+		}
+		c.JSON(200, gin.H{"digest": leaseDigest(leases), "count": len(leases)})
+	})
 	g.PUT("/leases/:id", func(c *gin.Context) {
+		// Checked at request time, not just at registration: this route is
+		// always mounted (see Start) so a write arriving mid-handshake, or
+		// one sent by a peer that hasn't noticed raft took over yet, is
+		// rejected rather than applied straight into the DataStore and
+		// racing the raft log for the same lease.
+		if r.raft != nil {
+			c.AbortWithStatus(409)
+			return
+		}
 		if !strings.HasPrefix(c.ContentType(), "application/json") {
 			c.AbortWithStatus(400)
 			return
@@ -136,9 +294,9 @@ func (r *Replication) setupHandlers() {
 			return
 		}
 
-		err = r.store.UpsertLease(&lease)
+		err = r.store.Merge(&lease)
 		if err != nil {
-			r.l.With(zap.Error(err)).Warn("failed to update lease")
+			r.l.With(zap.Error(err)).Warn("failed to merge lease")
 			c.AbortWithStatus(500)
 			return
 		}
@@ -146,8 +304,51 @@ func (r *Replication) setupHandlers() {
 	})
 }
 
+// RegisterRaftAdmin sets r.raft, which retires the basic-auth PUT/full-sync
+// gossip handlers in favour of the raft transport (see setupHandlers and
+// RunAntiEntropy, both of which check r.raft at request/run time rather than
+// depending on being called after this), and mounts cluster membership
+// management under /cluster/members, behind the same basic-auth block as
+// the rest of the replication API. The `peers` config list remains only the
+// bootstrap configuration; membership changes after that go through these
+// endpoints.
+func (r *Replication) RegisterRaftAdmin(raft *RaftReplication) {
+	r.raft = raft
+	r.g.POST("/cluster/members/:id", func(c *gin.Context) {
+		addr := c.Query("addr")
+		if addr == "" {
+			c.AbortWithStatus(400)
+			return
+		}
+		if err := raft.AddPeer(c.Param("id"), addr); err != nil {
+			r.l.With(zap.Error(err)).Warn("failed to add raft peer")
+			if err == ErrNotLeader {
+				c.Header("X-Raft-Leader", raft.Leader())
+				c.AbortWithStatus(409)
+				return
+			}
+			c.AbortWithStatus(500)
+			return
+		}
+		c.Status(204)
+	})
+	r.g.DELETE("/cluster/members/:id", func(c *gin.Context) {
+		if err := raft.RemovePeer(c.Param("id")); err != nil {
+			r.l.With(zap.Error(err)).Warn("failed to remove raft peer")
+			if err == ErrNotLeader {
+				c.Header("X-Raft-Leader", raft.Leader())
+				c.AbortWithStatus(409)
+				return
+			}
+			c.AbortWithStatus(500)
+			return
+		}
+		c.Status(204)
+	})
+}
+
 func (r *Replication) PortMappingLeaseListener(lease PortMappingLease) {
-	if r.listenAddr == "" {
+	if r.listenAddr == "" || r.raft != nil {
 		return
 	}
 	r.l.Sugar().Debug("received update for lease %s", lease.Id)
@@ -170,12 +371,14 @@ func (r *Replication) PortMappingLeaseListener(lease PortMappingLease) {
 
 		response, err := r.client.Do(req)
 		if err != nil {
+			replicationPeerSyncFailuresTotal.WithLabelValues(peer).Inc()
 			r.l.With(zap.Error(err), zap.String("url.origin", u)).Warn("failed to put lease")
 			continue
 		}
 		defer response.Body.Close()
 
 		if response.StatusCode != 200 {
+			replicationPeerSyncFailuresTotal.WithLabelValues(peer).Inc()
 			r.l.With(zap.String("url.origin", u), zap.Int("http.response.status_code", response.StatusCode)).
 				Warn("unexpected response status code")
 			continue
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// UserspaceBackend is a PortPublisher that proxies each lease's external
+// port to ClientIP:ClientPort with plain Go listeners instead of programming
+// any kernel NAT, the same approach Docker's docker-proxy/libnetwork
+// userland proxy takes on platforms (or unprivileged containers) where
+// iptables/XDP aren't available. It's slower than both - every byte is
+// copied through userspace instead of NATed in the kernel - but unlike
+// iptables and XDP it needs no special capability and works the same on
+// any OS the net package supports, which is what makes it
+// usable from CI and non-Linux dev boxes.
+type UserspaceBackend struct {
+	l                *zap.SugaredLogger
+	reconcileCh      chan interface{}
+	reconcileCloseCh chan interface{}
+
+	mu      sync.Mutex
+	proxies map[string]*userspaceProxy // keyed by lease Id
+}
+
+// userspaceProxy is the listener(s) backing a single lease's external port.
+type userspaceProxy struct {
+	lease   *PortMappingLease
+	tcpLn   net.Listener
+	udpConn *net.UDPConn
+	closeCh chan struct{}
+}
+
+func NewUserspaceBackend(l *zap.Logger) (*UserspaceBackend, error) {
+	return &UserspaceBackend{
+		l:                l.Named("userspace").Sugar(),
+		reconcileCh:      make(chan interface{}, 2),
+		reconcileCloseCh: make(chan interface{}, 2),
+		proxies:          make(map[string]*userspaceProxy),
+	}, nil
+}
+
+func (u *UserspaceBackend) StartReconcile(leasesFn func() ([]*PortMappingLease, error)) {
+	timer := time.NewTicker(2 * time.Minute)
+	reconcileFn := func() {
+		u.l.Debug("reconcile userspace proxies")
+		leases, err := leasesFn()
+		if err != nil {
+			return
+		}
+		u.EnsureMappings(leases)
+	}
+	for {
+		select {
+		case <-timer.C:
+			reconcileFn()
+		case <-u.reconcileCh:
+			reconcileFn()
+		case <-u.reconcileCloseCh:
+			return
+		}
+	}
+}
+
+func (u *UserspaceBackend) Reconcile() {
+	u.reconcileCh <- true
+}
+
+func (u *UserspaceBackend) Close() {
+	u.reconcileCloseCh <- true
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for id, p := range u.proxies {
+		u.stopProxy(p)
+		delete(u.proxies, id)
+	}
+}
+
+// EnsureMappings starts a proxy for every lease that doesn't have one yet
+// and stops every proxy whose lease is gone, the same add-what's-missing,
+// remove-what's-stale diff IPTablesManager.EnsureMappings does against its
+// chains.
+func (u *UserspaceBackend) EnsureMappings(leases []*PortMappingLease) {
+	start := time.Now()
+	defer func() {
+		userspaceReconcileDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	wanted := make(map[string]*PortMappingLease, len(leases))
+	for _, lease := range leases {
+		wanted[lease.Id] = lease
+	}
+
+	for id, p := range u.proxies {
+		if _, ok := wanted[id]; !ok {
+			u.stopProxy(p)
+			delete(u.proxies, id)
+		}
+	}
+
+	for id, lease := range wanted {
+		if _, ok := u.proxies[id]; ok {
+			continue
+		}
+		p, err := u.startProxy(lease)
+		if err != nil {
+			userspaceProxyErrorsTotal.Inc()
+			u.l.With(zap.Error(err)).Errorf("failed to start userspace proxy for lease %s external port %d", id, lease.ExternalPort)
+			continue
+		}
+		u.proxies[id] = p
+	}
+
+	userspaceActiveProxies.Set(float64(len(u.proxies)))
+}
+
+func (u *UserspaceBackend) startProxy(lease *PortMappingLease) (*userspaceProxy, error) {
+	p := &userspaceProxy{lease: lease, closeCh: make(chan struct{})}
+	backend := hostPort(lease.ClientIP, lease.ClientPort)
+
+	switch lease.Protocol {
+	case TCP:
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", lease.ExternalPort))
+		if err != nil {
+			return nil, err
+		}
+		p.tcpLn = ln
+		go u.serveTCP(p, backend)
+	case UDP:
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(lease.ExternalPort)})
+		if err != nil {
+			return nil, err
+		}
+		p.udpConn = conn
+		go u.serveUDP(p, backend)
+	default:
+		return nil, fmt.Errorf("unsupported protocol %s", lease.Protocol)
+	}
+	return p, nil
+}
+
+func (u *UserspaceBackend) stopProxy(p *userspaceProxy) {
+	close(p.closeCh)
+	if p.tcpLn != nil {
+		p.tcpLn.Close()
+	}
+	if p.udpConn != nil {
+		p.udpConn.Close()
+	}
+}
+
+// serveTCP accepts connections on the external port and relays each one to
+// backend, copying both directions until either side closes.
+func (u *UserspaceBackend) serveTCP(p *userspaceProxy, backend string) {
+	for {
+		conn, err := p.tcpLn.Accept()
+		if err != nil {
+			select {
+			case <-p.closeCh:
+				return
+			default:
+				u.l.With(zap.Error(err)).Warnf("accept failed for lease %s", p.lease.Id)
+				return
+			}
+		}
+		go u.relayTCP(conn, backend)
+	}
+}
+
+func (u *UserspaceBackend) relayTCP(client net.Conn, backend string) {
+	defer client.Close()
+	upstream, err := net.DialTimeout("tcp", backend, 5*time.Second)
+	if err != nil {
+		u.l.With(zap.Error(err)).Warnf("failed to dial backend %s", backend)
+		return
+	}
+	defer upstream.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, client)
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, upstream)
+	}()
+	wg.Wait()
+}
+
+// serveUDP relays datagrams between the external port and backend without
+// conntrack: since net.UDPConn has no "session", each client address gets
+// its own goroutine/socket pair that forwards backend's replies back,
+// torn down after udpSessionIdleTimeout of silence.
+const udpSessionIdleTimeout = 2 * time.Minute
+
+func (u *UserspaceBackend) serveUDP(p *userspaceProxy, backend string) {
+	sessions := make(map[string]*net.UDPConn)
+	var sessionsMu sync.Mutex
+
+	buf := make([]byte, 65535)
+	for {
+		n, clientAddr, err := p.udpConn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-p.closeCh:
+				return
+			default:
+				u.l.With(zap.Error(err)).Warnf("read failed for lease %s", p.lease.Id)
+				return
+			}
+		}
+
+		sessionsMu.Lock()
+		backendConn, ok := sessions[clientAddr.String()]
+		if !ok {
+			conn, err := net.DialTimeout("udp", backend, 5*time.Second)
+			if err != nil {
+				sessionsMu.Unlock()
+				u.l.With(zap.Error(err)).Warnf("failed to dial backend %s", backend)
+				continue
+			}
+			backendConn = conn.(*net.UDPConn)
+			sessions[clientAddr.String()] = backendConn
+			go u.pumpUDPReplies(p, backendConn, clientAddr, sessions, &sessionsMu, clientAddr.String())
+		}
+		sessionsMu.Unlock()
+
+		if _, err := backendConn.Write(buf[:n]); err != nil {
+			u.l.With(zap.Error(err)).Warnf("write to backend %s failed", backend)
+		}
+	}
+}
+
+// pumpUDPReplies copies backendConn's replies back out through the shared
+// external-port socket to client, until backendConn goes quiet for
+// udpSessionIdleTimeout or the proxy is stopped.
+func (u *UserspaceBackend) pumpUDPReplies(p *userspaceProxy, backendConn *net.UDPConn, client *net.UDPAddr, sessions map[string]*net.UDPConn, sessionsMu *sync.Mutex, key string) {
+	defer func() {
+		sessionsMu.Lock()
+		delete(sessions, key)
+		sessionsMu.Unlock()
+		backendConn.Close()
+	}()
+
+	buf := make([]byte, 65535)
+	for {
+		backendConn.SetReadDeadline(time.Now().Add(udpSessionIdleTimeout))
+		n, err := backendConn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := p.udpConn.WriteToUDP(buf[:n], client); err != nil {
+			return
+		}
+		select {
+		case <-p.closeCh:
+			return
+		default:
+		}
+	}
+}